@@ -0,0 +1,60 @@
+package machid
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+)
+
+// ================================================================================
+// Per-Boot Identifier
+// ================================================================================
+//
+// The BootMachID sits between the eMachID and the reMachID: it is stable for
+// the uptime of the host and changes on every reboot. It is an HMAC of the
+// kernel's random boot_id keyed with the application salt, so the raw boot_id
+// is never exposed and different applications get unrelated IDs.
+
+// ErrNoBootID is returned when the kernel boot ID is not available
+var ErrNoBootID = errors.New("machid: kernel boot ID not available")
+
+// bootIDPath is the kernel's random per-boot identifier
+var bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// readBootID returns the current boot ID, or "" if it is unavailable.
+func readBootID() string {
+	data, err := os.ReadFile(bootIDPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// GenerateBootMachID generates a per-boot identifier that is stable until the
+// host reboots. Does NOT require root privileges.
+//
+// Parameters:
+//   - salt: A non-empty string keying the identifier
+//
+// Returns:
+//   - The BootMachID as a hex-encoded HMAC-SHA256
+//   - ErrEmptySalt if salt is empty, or ErrNoBootID if the boot ID is unavailable
+//     (e.g. on non-Linux systems)
+func GenerateBootMachID(salt string) (string, error) {
+	if salt == "" {
+		return "", ErrEmptySalt
+	}
+	bootID := readBootID()
+	if bootID == "" {
+		return "", ErrNoBootID
+	}
+
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte("machid boot id\x00"))
+	mac.Write([]byte(bootID))
+	clearString(&bootID)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
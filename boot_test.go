@@ -0,0 +1,40 @@
+package machid
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateBootMachID(t *testing.T) {
+	path := useTempBootID(t, "6f1b3c2a-9d8e-4f7a-b5c6-1a2b3c4d5e6f")
+
+	first, err := GenerateBootMachID("test-salt")
+	if err != nil || len(first) != 64 {
+		t.Fatalf("GenerateBootMachID() = %q, %v", first, err)
+	}
+	if strings.Contains(first, "6f1b3c2a") {
+		t.Error("GenerateBootMachID() leaks the raw boot ID")
+	}
+	if again, _ := GenerateBootMachID("test-salt"); again != first {
+		t.Error("GenerateBootMachID() changed within a boot")
+	}
+	if other, _ := GenerateBootMachID("other-salt"); other == first {
+		t.Error("GenerateBootMachID() is the same for different salts")
+	}
+
+	os.WriteFile(path, []byte("0a9b8c7d-6e5f-4a3b-2c1d-0e9f8a7b6c5d\n"), 0600)
+	if rebooted, _ := GenerateBootMachID("test-salt"); rebooted == first {
+		t.Error("GenerateBootMachID() did not change after a reboot")
+	}
+
+	bootIDPath = filepath.Join(t.TempDir(), "missing")
+	if _, err := GenerateBootMachID("test-salt"); !errors.Is(err, ErrNoBootID) {
+		t.Errorf("GenerateBootMachID() without boot ID expected ErrNoBootID, got: %v", err)
+	}
+	if _, err := GenerateBootMachID(""); !errors.Is(err, ErrEmptySalt) {
+		t.Errorf("GenerateBootMachID() with empty salt expected ErrEmptySalt, got: %v", err)
+	}
+}
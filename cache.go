@@ -0,0 +1,768 @@
+package machid
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ================================================================================
+// Caching API
+// ================================================================================
+//
+// The caching system allows applications to cache machine IDs to avoid requiring
+// sudo on every run. The first run with sudo generates and caches the IDs, and
+// subsequent runs can use the cached values without elevated privileges.
+//
+// The cache is divided into application namespaces, each with its own IDs,
+// action count and timestamps, so applications using different salts on the
+// same host do not overwrite each other.
+
+// CachedMachineIDs holds cached machine identifiers
+type CachedMachineIDs struct {
+	ReMachID    string `json:"remach_id"`
+	ReMachIDMAC string `json:"remach_id_mac,omitempty"` // See VerifyReMachID
+	EMachID     string `json:"emach_id,omitempty"`
+
+	// Salt is never persisted. When set on a cache being saved, a keyed
+	// verifier is stored in SaltVerifier instead (see MatchesSalt).
+	Salt         string `json:"-"`
+	SaltVerifier string `json:"salt_verifier,omitempty"`
+
+	ActionCount int   `json:"action_count"`
+	CreatedAt   int64 `json:"created_at,omitempty"`
+	UpdatedAt   int64 `json:"updated_at,omitempty"` // Unix time of the last change
+
+	// Rotation metadata for the eMachID (see RotationPolicy)
+	EMachIDCreatedAt int64  `json:"emach_id_created_at,omitempty"` // Unix time the eMachID was generated
+	BootID           string `json:"boot_id,omitempty"`             // Kernel boot ID when the eMachID was generated
+	EMachIDBinding   string `json:"emach_id_binding,omitempty"`    // Fingerprint of the reMachID when the eMachID was generated
+
+	// EMachIDGeneration counts the eMachIDs generated (see RollbackPolicy)
+	EMachIDGeneration uint64 `json:"emach_id_generation,omitempty"`
+
+	// EMachIDHistory holds retired eMachIDs, oldest first (see SetEMachIDHistoryLimit)
+	EMachIDHistory []RetiredEMachID `json:"emach_id_history,omitempty"`
+
+	// Revalidation metadata for the reMachID (see CachePolicy)
+	VerifiedAt int64 `json:"verified_at,omitempty"` // Unix time it was last derived from the hardware
+	ExpiresAt  int64 `json:"expires_at,omitempty"`  // Unix time it expires (0 = never)
+}
+
+// DefaultCacheNamespace is the namespace used by legacy caches and by the
+// first application on a host that does not configure a namespace.
+const DefaultCacheNamespace = "default"
+
+// Default cache directory (user-specific)
+var (
+	cacheSubDir = ".config/machid"
+	cacheFile   = "cache.json"
+)
+
+var (
+	// cacheNamespace is the namespace configured with SetCacheNamespace
+	cacheNamespace string
+
+	// activeNamespace is the namespace last selected by a salt-taking call
+	activeNamespace string
+
+	cacheNamespaceMu sync.RWMutex
+)
+
+// SetCacheNamespace sets the cache namespace used by this process.
+// Pass an empty string to select namespaces automatically: the salt-taking
+// functions (GetOrGenerate*, RotateEMachID) then use the namespace whose
+// recorded salt matches, creating one if needed.
+//
+// Parameters:
+//   - name: The application namespace, e.g. "myapp"
+func SetCacheNamespace(name string) {
+	cacheNamespaceMu.Lock()
+	defer cacheNamespaceMu.Unlock()
+	cacheNamespace = name
+	activeNamespace = ""
+}
+
+// GetCacheNamespace returns the namespace configured with SetCacheNamespace.
+func GetCacheNamespace() string {
+	cacheNamespaceMu.RLock()
+	defer cacheNamespaceMu.RUnlock()
+	return cacheNamespace
+}
+
+// currentNamespace returns the namespace used by functions that do not take
+// a salt (LoadCachedIDs, SaveCachedIDs, UpdateCachedIDs, IncrementActionCount):
+// the configured namespace, else the one last selected by a salt-taking call
+// in this process, else DefaultCacheNamespace.
+func currentNamespace() string {
+	cacheNamespaceMu.RLock()
+	defer cacheNamespaceMu.RUnlock()
+	if cacheNamespace != "" {
+		return cacheNamespace
+	}
+	if activeNamespace != "" {
+		return activeNamespace
+	}
+	return DefaultCacheNamespace
+}
+
+// setActiveNamespace records the namespace selected for a salt.
+func setActiveNamespace(name string) {
+	cacheNamespaceMu.Lock()
+	defer cacheNamespaceMu.Unlock()
+	if cacheNamespace == "" {
+		activeNamespace = name
+	}
+}
+
+// findNamespace returns the namespace for salt in doc. If none exists and
+// create is true, a name for a new namespace is returned.
+func findNamespace(doc *cacheDocument, salt string, create bool) (string, bool) {
+	if name := GetCacheNamespace(); name != "" {
+		return name, true
+	}
+
+	// Namespace whose recorded salt matches
+	for _, name := range doc.names() {
+		if entry := doc.Namespaces[name]; entry.SaltVerifier != "" && entry.MatchesSalt(salt) {
+			return name, true
+		}
+	}
+
+	// The default namespace, unless another salt already claimed it
+	entry, exists := doc.Namespaces[DefaultCacheNamespace]
+	if exists && entry.SaltVerifier == "" {
+		return DefaultCacheNamespace, true
+	}
+	if !create {
+		return "", false
+	}
+	if !exists {
+		return DefaultCacheNamespace, true
+	}
+
+	suffix, err := generateRandomHex(4)
+	if err != nil {
+		suffix = fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return "app-" + suffix, true
+}
+
+// loadCacheDocument loads and decodes the whole cache. A missing cache yields
+// an empty document. If the stored form was migrated, it is persisted.
+func loadCacheDocument() (*cacheDocument, error) {
+	data, err := activeCacheStore().Load()
+	if errors.Is(err, fs.ErrNotExist) {
+		return newCacheDocument(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := GetCacheEncryption()
+	data, encrypted, err := openCacheData(provider, data)
+	if err != nil {
+		return nil, err
+	}
+	doc, migrated, err := decodeCacheDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	migrated = migrated || encrypted != (provider != nil)
+
+	// Persist the migrated form (e.g. replace a legacy plaintext salt)
+	if migrated && !IsNoWriteMode() {
+		if err := updateCacheDocument(func(*cacheDocument) error { return nil }); err != nil {
+			logWarning(fmt.Sprintf("WARNING: machid - Failed to migrate cache: %v", err))
+		}
+	}
+	return doc, nil
+}
+
+// updateCacheDocument runs a locked read-modify-write transaction on the whole
+// cache. The result is only saved if it changed.
+func updateCacheDocument(fn func(doc *cacheDocument) error) error {
+	return updateCacheDocumentIn(activeCacheStore(), GetCacheEncryption(), fn)
+}
+
+// updateCacheDocumentIn runs a cache document transaction on the given store,
+// encrypting the cache if provider is set.
+func updateCacheDocumentIn(store CacheStore, provider KeyProvider, fn func(doc *cacheDocument) error) error {
+	unlock, err := lockCacheStore(store)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	stored, err := store.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	doc := newCacheDocument()
+	var before []byte
+	encrypted := false
+	if err == nil {
+		if before, encrypted, err = openCacheData(provider, stored); err != nil {
+			return err
+		}
+		if doc, _, err = decodeCacheDocument(before); err != nil {
+			return err
+		}
+	}
+
+	if err := fn(doc); err != nil {
+		return err
+	}
+
+	if len(doc.Namespaces) == 0 {
+		if stored == nil {
+			return nil
+		}
+		return store.Clear()
+	}
+
+	after, err := encodeCacheDocument(doc)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(before, after) && encrypted == (provider != nil) {
+		return nil
+	}
+	if after, err = sealCacheData(provider, after); err != nil {
+		return err
+	}
+	return store.Save(after)
+}
+
+// discardCorruptCache removes the stored cache if it cannot be parsed. Caches
+// that are readable, or written by a newer schema version, are kept.
+func discardCorruptCache() error {
+	store := activeCacheStore()
+
+	unlock, err := lockCacheStore(store)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	data, err := store.Load()
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	data, _, err = openCacheData(GetCacheEncryption(), data)
+	if err != nil {
+		return nil
+	}
+	if _, _, err := decodeCacheDocument(data); !errors.Is(err, ErrCacheCorrupt) {
+		return nil
+	}
+	return store.Clear()
+}
+
+// recoverCacheError handles a cache read error on behalf of the GetOrGenerate*
+// functions. A corrupt cache is logged and discarded so the IDs can be
+// regenerated, in which case nil is returned. Other errors, including
+// ErrCacheVersionTooNew, are returned unchanged.
+func recoverCacheError(err error) error {
+	if !errors.Is(err, ErrCacheCorrupt) {
+		return err
+	}
+	logWarning(fmt.Sprintf("WARNING: machid - Discarding unreadable cache: %v", err))
+	return discardCorruptCache()
+}
+
+// isFatalCacheError reports whether a cache error must be returned by the
+// GetOrGenerate* functions rather than worked around: the cache exists but must
+// not be overwritten (written by a newer version, or encrypted with another key).
+func isFatalCacheError(err error) bool {
+	return errors.Is(err, ErrCacheVersionTooNew) || errors.Is(err, ErrCacheDecrypt)
+}
+
+// updateNamespace runs fn on a single namespace entry within a transaction.
+// The entry is created if needed; UpdatedAt is set when fn changes it.
+func updateNamespace(doc *cacheDocument, name string, fn func(cache *CachedMachineIDs) error) error {
+	entry, exists := doc.Namespaces[name]
+	if !exists {
+		entry = &CachedMachineIDs{}
+	}
+	original := *entry
+	original.EMachIDHistory = slices.Clone(entry.EMachIDHistory)
+
+	if err := fn(entry); err != nil {
+		return err
+	}
+
+	if reflect.DeepEqual(original, *entry) {
+		return nil
+	}
+	entry.UpdatedAt = time.Now().Unix()
+	doc.Namespaces[name] = entry
+	return nil
+}
+
+// updateForSalt runs fn on the namespace belonging to salt.
+func updateForSalt(salt string, fn func(cache *CachedMachineIDs) error) error {
+	return updateCacheDocument(func(doc *cacheDocument) error {
+		name, _ := findNamespace(doc, salt, true)
+		setActiveNamespace(name)
+		return updateNamespace(doc, name, fn)
+	})
+}
+
+// loadForSalt returns the cached entry belonging to salt, or nil if none exists.
+func loadForSalt(salt string) (*CachedMachineIDs, error) {
+	doc, err := loadCacheDocument()
+	if err != nil {
+		return nil, err
+	}
+	name, ok := findNamespace(doc, salt, false)
+	if !ok {
+		return nil, nil
+	}
+	setActiveNamespace(name)
+	return doc.Namespaces[name], nil
+}
+
+// LoadCachedIDs loads the cached machine IDs of the current namespace from the
+// configured CacheStore (cache.json by default, see SetCacheStore).
+// Returns an error wrapping fs.ErrNotExist if no cache exists, or a *CacheError
+// if the cache is corrupt, was written by a newer library version, or cannot be
+// decrypted (ErrCacheDecrypt, see SetCacheEncryption).
+func LoadCachedIDs() (*CachedMachineIDs, error) {
+	return LoadCacheNamespace(currentNamespace())
+}
+
+// SaveCachedIDs saves machine IDs to the current namespace in the configured
+// CacheStore (cache.json by default, see SetCacheStore).
+func SaveCachedIDs(cache *CachedMachineIDs) error {
+	return updateCacheDocument(func(doc *cacheDocument) error {
+		saved := *cache
+		saved.UpdatedAt = time.Now().Unix()
+		doc.Namespaces[currentNamespace()] = &saved
+		return nil
+	})
+}
+
+// UpdateCachedIDs runs a read-modify-write transaction on the cache of the
+// current namespace. fn receives the current cache (zero-valued if no cache
+// exists) and may modify it; the result is saved unless fn returns an error or
+// leaves it unchanged.
+//
+// Transactions are serialized within the process, and across processes for
+// stores implementing CacheLocker (such as FileCacheStore), so concurrent
+// updates are never lost.
+func UpdateCachedIDs(fn func(cache *CachedMachineIDs) error) error {
+	return updateCacheDocument(func(doc *cacheDocument) error {
+		return updateNamespace(doc, currentNamespace(), fn)
+	})
+}
+
+// isEmpty reports whether the cache holds no data at all.
+func (c *CachedMachineIDs) isEmpty() bool {
+	return reflect.DeepEqual(*c, CachedMachineIDs{})
+}
+
+// ClearCache removes the cached machine IDs of the current namespace.
+// Other namespaces are kept; use DeleteCacheNamespace to remove them.
+// A corrupt cache is removed entirely, since its namespaces cannot be told apart.
+func ClearCache() error {
+	err := DeleteCacheNamespace(currentNamespace())
+	if errors.Is(err, ErrCacheCorrupt) {
+		return discardCorruptCache()
+	}
+	return err
+}
+
+// ListCacheNamespaces returns the names of all cache namespaces, sorted.
+func ListCacheNamespaces() ([]string, error) {
+	doc, err := loadCacheDocument()
+	if err != nil {
+		return nil, err
+	}
+	return doc.names(), nil
+}
+
+// LoadCacheNamespace returns the cached machine IDs of the named namespace.
+// Returns an error wrapping fs.ErrNotExist if the namespace does not exist.
+func LoadCacheNamespace(name string) (*CachedMachineIDs, error) {
+	doc, err := loadCacheDocument()
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := doc.Namespaces[name]
+	if !ok {
+		return nil, fmt.Errorf("machid: cache namespace %q: %w", name, fs.ErrNotExist)
+	}
+	return entry, nil
+}
+
+// DeleteCacheNamespace removes a namespace from the cache. Deleting a
+// namespace that does not exist is not an error.
+func DeleteCacheNamespace(name string) error {
+	return updateCacheDocument(func(doc *cacheDocument) error {
+		delete(doc.Namespaces, name)
+		return nil
+	})
+}
+
+// GetOrGenerateReMachID attempts to load the cached reMachID, or generates a new one.
+// If generation is needed, sudo is required. The generated ID is cached for future use.
+//
+// Parameters:
+//   - salt: Salt for the machine ID (must match previous runs for consistent IDs)
+//
+// Returns:
+//   - The reMachID
+//   - Whether the ID was loaded from cache (true) or freshly generated (false)
+//   - An error if generation fails (including if sudo is required but not available),
+//     or a *CacheError wrapping ErrCacheVersionTooNew or ErrCacheDecrypt if the
+//     cache cannot be used. A corrupt cache is logged and regenerated.
+func GetOrGenerateReMachID(salt string) (remachid string, fromCache bool, err error) {
+	remachid, status, err := GetOrGenerateReMachIDWithStatus(salt)
+	return remachid, status != CacheStatusRefreshed, err
+}
+
+// GetOrGenerateReMachIDWithStatus is like GetOrGenerateReMachID, but applies
+// the CachePolicy and reports whether the returned reMachID was trusted from
+// the cache, revalidated against the hardware, or refreshed.
+//
+// Parameters:
+//   - salt: Salt for the machine ID (must match previous runs for consistent IDs)
+//
+// Returns:
+//   - The reMachID
+//   - How the reMachID was obtained
+//   - An error if generation fails (including if sudo is required but not available),
+//     a *CacheError wrapping ErrCacheExpired or ErrCacheTampered if the cached
+//     value cannot be trusted without root, or a *CacheError wrapping
+//     ErrCacheVersionTooNew or ErrCacheDecrypt if the cache cannot be used
+func GetOrGenerateReMachIDWithStatus(salt string) (remachid string, status CacheStatus, err error) {
+	policy := GetCachePolicy()
+	now := time.Now()
+
+	// The system cache takes precedence over the per-user cache
+	var cached string
+	if entry := loadSystemEntry(salt); entry != nil && !policy.AlwaysFresh && !policy.expired(entry, now) {
+		if !policy.RevalidateAsRoot || checkRoot() != nil {
+			syncUserCache(salt, entry)
+			return entry.ReMachID, CacheStatusTrusted, nil
+		}
+		cached = entry.ReMachID
+	}
+
+	// Try loading from the per-user cache
+	cache, err := loadForSalt(salt)
+	if err != nil {
+		if err = recoverCacheError(err); isFatalCacheError(err) {
+			return "", CacheStatusRefreshed, err
+		}
+	}
+
+	if cached == "" && cache != nil && cache.ReMachID != "" && !policy.AlwaysFresh {
+		// Verify salt matches if recorded in cache
+		if !cache.MatchesSalt(salt) {
+			// Salt mismatch in a configured namespace - need to regenerate
+			logWarning("WARNING: machid - Salt mismatch in cache, regenerating reMachID")
+		} else if err := cache.VerifyReMachID(salt); err != nil {
+			logWarning(fmt.Sprintf("WARNING: machid - Rejecting cached reMachID in namespace %q: %v", currentNamespace(), err))
+			if checkRoot() != nil {
+				return "", CacheStatusRefreshed, err
+			}
+		} else if policy.expired(cache, now) {
+			if checkRoot() != nil {
+				return "", CacheStatusRefreshed, &CacheError{Op: "validate", Err: ErrCacheExpired}
+			}
+			cached = cache.ReMachID
+		} else if !policy.RevalidateAsRoot || checkRoot() != nil {
+			return cache.ReMachID, CacheStatusTrusted, nil
+		} else {
+			cached = cache.ReMachID
+		}
+	}
+
+	// Need to generate - this requires sudo
+	remachid, err = GenerateReMachID(salt)
+	if err != nil {
+		return "", CacheStatusRefreshed, err
+	}
+
+	status = CacheStatusRefreshed
+	if cached != "" {
+		if remachid == cached {
+			status = CacheStatusRevalidated
+		} else {
+			logWarning(fmt.Sprintf("WARNING: machid - Cached reMachID does not match this machine in namespace %q, replacing it", currentNamespace()))
+		}
+	}
+
+	// Save to cache, preserving the eMachID and action count if present
+	saveErr := updateForSalt(salt, func(cache *CachedMachineIDs) error {
+		if cache.ReMachID != remachid || cache.CreatedAt == 0 {
+			cache.CreatedAt = now.Unix()
+		}
+		cache.ReMachID = remachid
+		cache.assignSalt(salt)
+		policy.stamp(cache, now)
+		return nil
+	})
+	if saveErr != nil {
+		logWarning(fmt.Sprintf("WARNING: machid - Failed to cache reMachID: %v", saveErr))
+	}
+	saveSystemEntry(salt, remachid, policy, now)
+
+	return remachid, status, nil
+}
+
+// syncUserCache replaces a stale per-user reMachID with the system cache entry.
+func syncUserCache(salt string, entry *CachedMachineIDs) {
+	err := updateForSalt(salt, func(cache *CachedMachineIDs) error {
+		if cache.ReMachID == entry.ReMachID && cache.VerifyReMachID(salt) == nil {
+			return nil
+		}
+		cache.ReMachID = entry.ReMachID
+		cache.assignSalt(salt)
+		cache.CreatedAt = entry.CreatedAt
+		cache.VerifiedAt = entry.VerifiedAt
+		cache.ExpiresAt = entry.ExpiresAt
+		return nil
+	})
+	if err != nil {
+		logWarning(fmt.Sprintf("WARNING: machid - Failed to update cache from system cache: %v", err))
+	}
+}
+
+// GetOrGenerateEMachID attempts to load the cached eMachID, or generates a new one.
+// This function does NOT require sudo since eMachID generation uses timestamps only.
+// The cached eMachID is rotated when the RotationPolicy requires it, or when a
+// rollback is detected under RollbackRotate (see RollbackPolicy).
+//
+// Parameters:
+//   - salt: Salt for the machine ID
+//
+// Returns:
+//   - The eMachID
+//   - Whether the ID was loaded from cache (true) or freshly generated (false)
+//   - An error if generation fails, or a *CacheError wrapping
+//     ErrCacheVersionTooNew or ErrCacheDecrypt if the cache cannot be used,
+//     or a *RollbackError under RollbackFail.
+//     A corrupt cache is logged and regenerated.
+func GetOrGenerateEMachID(salt string) (emachid string, fromCache bool, err error) {
+	policy := GetRotationPolicy()
+	guard := newRollbackGuard()
+	var genErr error
+	var rotation *RotationEvent
+	update := func(cache *CachedMachineIDs) error {
+		emachid, fromCache, rotation = "", false, nil
+		t := now()
+
+		rolledBack := guard.check(cache, t)
+		if rolledBack != "" && guard.fails() {
+			return guard.error(rolledBack)
+		}
+
+		// Keep the cached eMachID unless the rollback or rotation policy says otherwise
+		reason := ""
+		if cache.EMachID != "" {
+			if reason = policy.rotationReason(cache, t); rolledBack != "" {
+				reason = RotationReasonRollback
+			}
+			if reason == "" {
+				if cache.EMachIDBinding == "" {
+					cache.EMachIDBinding = reMachIDFingerprint(cache.ReMachID)
+				}
+				emachid, fromCache = cache.EMachID, true
+				return nil
+			}
+		}
+
+		// Generate new eMachID (no sudo required)
+		if emachid, genErr = GenerateEMachID(salt); genErr != nil {
+			return genErr
+		}
+		guard.raise(cache)
+
+		if reason != "" {
+			event := rotateEMachID(cache, emachid, reason, t)
+			rotation = &event
+			return nil
+		}
+
+		// Update existing cache with eMachID (or start a new one)
+		if cache.isEmpty() {
+			cache.Salt = salt
+			cache.CreatedAt = t.Unix()
+		}
+		setEMachID(cache, emachid, t)
+		return nil
+	}
+
+	saveErr := updateForSalt(salt, update)
+	if saveErr != nil && genErr == nil {
+		if saveErr = recoverCacheError(saveErr); saveErr == nil {
+			saveErr = updateForSalt(salt, update)
+		}
+	}
+	if genErr != nil {
+		return "", false, genErr
+	}
+	if isFatalCacheError(saveErr) || errors.Is(saveErr, ErrStateRollback) {
+		return "", false, saveErr
+	}
+
+	if saveErr != nil {
+		logWarning(fmt.Sprintf("WARNING: machid - Failed to cache eMachID: %v", saveErr))
+		// The cache could not be read - fall back to an uncached eMachID
+		if emachid == "" {
+			if emachid, err = GenerateEMachID(salt); err != nil {
+				return "", false, err
+			}
+		}
+	} else {
+		guard.record()
+		if rotation != nil {
+			notifyRotation(*rotation)
+		}
+	}
+
+	return emachid, fromCache, nil
+}
+
+// GetOrGenerateBoth loads or generates both machine IDs.
+// For reMachID, sudo is required if not cached.
+// For eMachID, sudo is never required.
+//
+// Parameters:
+//   - salt: Salt for both machine IDs
+//
+// Returns:
+//   - CachedMachineIDs containing both IDs
+//   - An error if reMachID generation fails (typically if sudo is needed but not available)
+func GetOrGenerateBoth(salt string) (*CachedMachineIDs, error) {
+	// Try to get reMachID first (may require sudo)
+	remachid, reCached, err := GetOrGenerateReMachID(salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reMachID: %w", err)
+	}
+
+	// Get eMachID (never requires sudo)
+	emachid, eCached, err := GetOrGenerateEMachID(salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get eMachID: %w", err)
+	}
+
+	// Load the namespace to get action count and timestamps
+	result := &CachedMachineIDs{}
+	if cache, _ := loadForSalt(salt); cache != nil {
+		*result = *cache
+	}
+	result.ReMachID = remachid
+	result.EMachID = emachid
+	result.Salt = salt
+
+	// Log caching status
+	if reCached && eCached {
+		logWarning("✓ Using cached machine IDs (no sudo required)")
+	} else if reCached {
+		logWarning("✓ Using cached reMachID, generated new eMachID")
+	} else {
+		logWarning("✓ Generated and cached machine IDs")
+	}
+
+	return result, nil
+}
+
+// RotateEMachID generates a new eMachID and updates the cache.
+// This should be called when you need to refresh the ephemeral ID, and to
+// resolve a *RollbackError under RollbackFail. Does NOT require sudo.
+//
+// Parameters:
+//   - salt: Salt for the new eMachID
+//
+// Returns:
+//   - The new eMachID
+//   - An error if generation or caching fails
+func RotateEMachID(salt string) (string, error) {
+	// Generate new eMachID
+	emachid, err := GenerateEMachID(salt)
+	if err != nil {
+		return "", err
+	}
+
+	guard := newRollbackGuard()
+	var event RotationEvent
+	err = updateForSalt(salt, func(cache *CachedMachineIDs) error {
+		if cache.isEmpty() {
+			cache.Salt = salt
+		}
+
+		// An explicit rotation accepts the current state, even if rolled back
+		t := now()
+		guard.check(cache, t)
+		guard.raise(cache)
+
+		// Update with new eMachID
+		event = rotateEMachID(cache, emachid, RotationReasonManual, t)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to save rotated eMachID: %w", err)
+	}
+	guard.record()
+	notifyRotation(event)
+
+	return emachid, nil
+}
+
+// IncrementActionCount increments the action counter in the cache of the
+// current namespace. Returns the new action count, or a *RollbackError if a
+// RollbackPolicy is set and the cache was rolled back.
+//
+// If enabled with SetActionJournal, the increment is also recorded to
+// ActionCounter in the counter journal (see IncrementCounter), which is not
+// reset on rotation.
+func IncrementActionCount() (int, error) {
+	guard := newRollbackGuard()
+	var count int
+	err := UpdateCachedIDs(func(cache *CachedMachineIDs) error {
+		if cache.isEmpty() {
+			return fs.ErrNotExist
+		}
+		if reason := guard.check(cache, now()); reason != "" {
+			return guard.error(reason)
+		}
+		cache.ActionCount++
+		count = cache.ActionCount
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	guard.record()
+
+	if IsActionJournal() && !IsNoWriteMode() {
+		if _, err := incrementCounter(currentNamespace(), ActionCounter, 1); err != nil {
+			logWarning(fmt.Sprintf("WARNING: machid - Failed to journal action: %v", err))
+		}
+	}
+
+	return count, nil
+}
+
+// names returns the namespace names in the document, sorted.
+func (d *cacheDocument) names() []string {
+	names := make([]string, 0, len(d.Namespaces))
+	for name := range d.Namespaces {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
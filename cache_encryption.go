@@ -0,0 +1,372 @@
+package machid
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ================================================================================
+// Cache Encryption
+// ================================================================================
+//
+// The per-user cache can be encrypted at rest with AES-256-GCM so backups and
+// casual inspection of home directories do not reveal machine IDs. The key
+// material comes from a KeyProvider; each write uses a fresh random salt and
+// nonce, and the file key is derived from the key material with HKDF-SHA256.
+// Passphrases are first stretched with PBKDF2-SHA256 under a random per-cache
+// salt stored in the envelope.
+// The system cache is never encrypted, since it is shared between users.
+
+// Cache encryption errors
+var (
+	// ErrCacheDecrypt is returned when an encrypted cache cannot be decrypted,
+	// e.g. because the key is wrong or unavailable or the ciphertext was modified
+	ErrCacheDecrypt = errors.New("machid: cache cannot be decrypted")
+
+	// ErrCacheKeyMissing is returned (together with ErrCacheDecrypt) when the
+	// key of an encrypted cache no longer exists, e.g. because a keyring key
+	// expired. Clear the cache to start over with a new key.
+	ErrCacheKeyMissing = errors.New("machid: cache encryption key is missing")
+)
+
+// Encrypted cache envelope
+const (
+	cacheEnvelopeVersion = 1
+	cacheEnvelopeCipher  = "aes-256-gcm"
+
+	// cachePassphraseKDF stretches passphrase keys
+	cachePassphraseKDF = "pbkdf2-sha256"
+
+	// cacheKDFSaltLength is the length of the per-cache passphrase KDF salt
+	cacheKDFSaltLength = 16
+)
+
+// passphraseKeyIterations is the PBKDF2-SHA256 iteration count for new passphrase keys
+var passphraseKeyIterations = 600_000
+
+// KeyProvider supplies the key material used to encrypt the cache.
+// Implementations must be safe for concurrent use and return the same key
+// material on every call.
+type KeyProvider interface {
+	// CacheKey returns the key material (at least 16 bytes).
+	CacheKey() ([]byte, error)
+}
+
+var (
+	// cacheKeyProvider configured with SetCacheEncryption (nil means plaintext)
+	cacheKeyProvider   KeyProvider
+	cacheKeyProviderMu sync.RWMutex
+)
+
+// SetCacheEncryption enables encryption of the per-user cache with key
+// material from provider. Existing plaintext caches are encrypted on their next
+// load; passing nil decrypts them again (this still needs the previous
+// provider, so disable encryption only after clearing the cache).
+//
+// Parameters:
+//   - provider: The key provider, or nil to store the cache in plaintext
+func SetCacheEncryption(provider KeyProvider) {
+	cacheKeyProviderMu.Lock()
+	defer cacheKeyProviderMu.Unlock()
+	cacheKeyProvider = provider
+}
+
+// GetCacheEncryption returns the configured key provider, or nil if the cache
+// is stored in plaintext.
+func GetCacheEncryption() KeyProvider {
+	cacheKeyProviderMu.RLock()
+	defer cacheKeyProviderMu.RUnlock()
+	return cacheKeyProvider
+}
+
+// passphraseKeyProvider stretches a passphrase with the KDF salt of the cache.
+// The last derivation is kept, so a cache is only stretched once per process.
+type passphraseKeyProvider struct {
+	passphrase string
+
+	mu         sync.Mutex
+	kdfSalt    []byte // Salt of the last derived key
+	iterations int    // Iteration count of the last derived key
+	key        []byte
+}
+
+// PassphraseKeyProvider returns a KeyProvider deriving the key from a
+// passphrase with PBKDF2-SHA256. Each cache gets its own random KDF salt,
+// stored in the encrypted envelope.
+func PassphraseKeyProvider(passphrase string) KeyProvider {
+	return &passphraseKeyProvider{passphrase: passphrase}
+}
+
+// CacheKey implements KeyProvider. It returns the key for the KDF salt of the
+// last cache read or written, or for a new random salt.
+func (p *passphraseKeyProvider) CacheKey() ([]byte, error) {
+	salt, iterations, err := p.kdfParams()
+	if err != nil {
+		return nil, err
+	}
+	return p.stretchKey(salt, iterations)
+}
+
+// kdfParams returns the KDF salt and iteration count for a new envelope: those
+// of the last derivation, so rewriting a cache does not stretch the passphrase
+// again, or a fresh random salt.
+func (p *passphraseKeyProvider) kdfParams() ([]byte, int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.kdfSalt != nil {
+		return p.kdfSalt, p.iterations, nil
+	}
+	salt := make([]byte, cacheKDFSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, 0, err
+	}
+	return salt, passphraseKeyIterations, nil
+}
+
+// stretchKey derives the key material for a KDF salt and iteration count.
+func (p *passphraseKeyProvider) stretchKey(salt []byte, iterations int) ([]byte, error) {
+	if p.passphrase == "" {
+		return nil, ErrEmptyPassphrase
+	}
+	if len(salt) != cacheKDFSaltLength || iterations <= 0 || iterations > maxBundleIterations {
+		return nil, fmt.Errorf("machid: invalid passphrase KDF parameters (%d-byte salt, %d iterations)", len(salt), iterations)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.key != nil && p.iterations == iterations && bytes.Equal(p.kdfSalt, salt) {
+		return p.key, nil
+	}
+	key, err := pbkdf2.Key(sha256.New, p.passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("machid: failed to derive cache key: %w", err)
+	}
+	p.kdfSalt, p.iterations, p.key = bytes.Clone(salt), iterations, key
+	return key, nil
+}
+
+// FileKeyProvider reads the key material from a file, e.g. one created with
+// "head -c 32 /dev/urandom > key". The file must not be a symlink or be
+// accessible by group or others.
+type FileKeyProvider struct {
+	Path string
+}
+
+// CacheKey implements KeyProvider.
+func (p *FileKeyProvider) CacheKey() ([]byte, error) {
+	fi, err := os.Lstat(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 || !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: %s is not a regular file", ErrInsecureCachePath, p.Path)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%w: %s is accessible by group or others", ErrInsecureCachePath, p.Path)
+	}
+
+	f, err := os.OpenFile(p.Path, os.O_RDONLY|oNoFollow, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	key, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < 16 {
+		return nil, fmt.Errorf("machid: key file %s is shorter than 16 bytes", p.Path)
+	}
+	return key, nil
+}
+
+// KeyringKeyProvider keeps random key material in the kernel keyring. The key
+// is created when a cache is first encrypted and shares the keyring's
+// lifetime: once it expires or is removed, the encrypted cache fails with
+// ErrCacheKeyMissing instead of being paired with a new key.
+type KeyringKeyProvider struct {
+	// Description is the key description. Defaults to "machid:cache-key".
+	Description string
+
+	// Keyring selects the keyring holding the key. Defaults to KeyringPersistent.
+	Keyring KeyringType
+
+	mu sync.Mutex
+}
+
+// store returns the keyring store holding the key.
+func (p *KeyringKeyProvider) store() *KeyringCacheStore {
+	description := p.Description
+	if description == "" {
+		description = "machid:cache-key"
+	}
+	return &KeyringCacheStore{Description: description, Keyring: p.Keyring}
+}
+
+// CacheKey implements KeyProvider. The key is created if it does not exist.
+func (p *KeyringKeyProvider) CacheKey() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	store := p.store()
+	key, err := store.Load()
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := store.Save(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// existingCacheKey returns the key without creating it.
+func (p *KeyringKeyProvider) existingCacheKey() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	store := p.store()
+	key, err := store.Load()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: keyring key %q expired or was removed", ErrCacheKeyMissing, store.Description)
+	}
+	return key, err
+}
+
+// existingKeyProvider is implemented by key providers that create their key
+// material on first use. existingCacheKey never creates it, so an existing
+// encrypted cache is not paired with new key material.
+type existingKeyProvider interface {
+	existingCacheKey() ([]byte, error)
+}
+
+// cacheEnvelope is the encoded form of an encrypted cache.
+type cacheEnvelope struct {
+	Encrypted  int    `json:"machid_encrypted"`
+	Cipher     string `json:"cipher"`
+	KDF        string `json:"kdf,omitempty"`        // Passphrase stretching (empty for raw key material)
+	Iterations int    `json:"iterations,omitempty"` // KDF iteration count
+	KDFSalt    []byte `json:"kdf_salt,omitempty"`   // Per-cache KDF salt
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// cacheKeyMaterial returns the key material for an envelope. Passphrases are
+// stretched with the envelope's KDF parameters, and when opening an existing
+// envelope, providers that create keys on first use must already hold one.
+func cacheKeyMaterial(provider KeyProvider, env *cacheEnvelope, existing bool) ([]byte, error) {
+	if p, ok := provider.(*passphraseKeyProvider); ok {
+		if env.KDF != cachePassphraseKDF {
+			return nil, fmt.Errorf("machid: cache was not encrypted with a passphrase (kdf %q)", env.KDF)
+		}
+		return p.stretchKey(env.KDFSalt, env.Iterations)
+	}
+	if env.KDF != "" {
+		return nil, fmt.Errorf("machid: cache was encrypted with a passphrase (kdf %q)", env.KDF)
+	}
+	if p, ok := provider.(existingKeyProvider); ok && existing {
+		return p.existingCacheKey()
+	}
+	return provider.CacheKey()
+}
+
+// cacheAEAD derives the AES-256-GCM cipher for an envelope.
+func cacheAEAD(provider KeyProvider, env *cacheEnvelope, existing bool) (cipher.AEAD, error) {
+	material, err := cacheKeyMaterial(provider, env, existing)
+	if err != nil {
+		return nil, err
+	}
+	if len(material) < 16 {
+		return nil, errors.New("machid: cache key material is shorter than 16 bytes")
+	}
+	key, err := hkdf.Key(sha256.New, material, env.Salt, "machid cache encryption", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealCacheData encrypts encoded cache data if provider is set.
+func sealCacheData(provider KeyProvider, data []byte) ([]byte, error) {
+	if provider == nil {
+		return data, nil
+	}
+
+	env := cacheEnvelope{Encrypted: cacheEnvelopeVersion, Cipher: cacheEnvelopeCipher, Salt: make([]byte, 16)}
+	if _, err := rand.Read(env.Salt); err != nil {
+		return nil, err
+	}
+	if p, ok := provider.(*passphraseKeyProvider); ok {
+		var err error
+		env.KDF = cachePassphraseKDF
+		if env.KDFSalt, env.Iterations, err = p.kdfParams(); err != nil {
+			return nil, err
+		}
+	}
+	aead, err := cacheAEAD(provider, &env, false)
+	if err != nil {
+		return nil, &CacheError{Op: "encrypt", Err: err}
+	}
+	env.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(env.Nonce); err != nil {
+		return nil, err
+	}
+	env.Ciphertext = aead.Seal(nil, env.Nonce, data, []byte(cacheEnvelopeCipher))
+	return json.MarshalIndent(env, "", "  ")
+}
+
+// openCacheData decrypts stored cache data if it is encrypted, and reports
+// whether it was. Plaintext data is returned unchanged.
+func openCacheData(provider KeyProvider, data []byte) (plain []byte, encrypted bool, err error) {
+	var env cacheEnvelope
+	if !strings.Contains(string(data), `"machid_encrypted"`) || json.Unmarshal(data, &env) != nil || env.Encrypted == 0 {
+		return data, false, nil
+	}
+
+	fail := func(err error) ([]byte, bool, error) {
+		return nil, true, &CacheError{Op: "decrypt", Err: fmt.Errorf("%w: %w", ErrCacheDecrypt, err)}
+	}
+	if env.Encrypted != cacheEnvelopeVersion || env.Cipher != cacheEnvelopeCipher {
+		return fail(fmt.Errorf("unsupported envelope version %d (%s)", env.Encrypted, env.Cipher))
+	}
+	if provider == nil {
+		return fail(errors.New("cache is encrypted but no key provider is configured"))
+	}
+	aead, err := cacheAEAD(provider, &env, true)
+	if err != nil {
+		return fail(err)
+	}
+	if len(env.Nonce) != aead.NonceSize() {
+		return fail(errors.New("invalid nonce"))
+	}
+	plain, err = aead.Open(nil, env.Nonce, env.Ciphertext, []byte(cacheEnvelopeCipher))
+	if err != nil {
+		return fail(errors.New("wrong key or modified ciphertext"))
+	}
+	return plain, true, nil
+}
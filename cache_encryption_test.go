@@ -0,0 +1,137 @@
+package machid
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func useCacheEncryption(t *testing.T, provider KeyProvider) {
+	t.Helper()
+	old := passphraseKeyIterations
+	passphraseKeyIterations = 1000
+	SetCacheEncryption(provider)
+	t.Cleanup(func() {
+		SetCacheEncryption(nil)
+		passphraseKeyIterations = old
+	})
+}
+
+func TestCacheEncryption_RoundTrip(t *testing.T) {
+	store := useMemoryCacheStore(t)
+	useCacheEncryption(t, PassphraseKeyProvider("correct horse"))
+
+	emachid, _, err := GetOrGenerateEMachID("test-salt")
+	if err != nil {
+		t.Fatalf("GetOrGenerateEMachID() failed: %v", err)
+	}
+	data, _ := store.Load()
+	if strings.Contains(string(data), emachid) || !strings.Contains(string(data), `"machid_encrypted"`) {
+		t.Errorf("cache is not encrypted: %s", data)
+	}
+
+	cache, err := LoadCachedIDs()
+	if err != nil || cache.EMachID != emachid {
+		t.Errorf("LoadCachedIDs() = %+v, %v; expected decrypted cache", cache, err)
+	}
+
+	// Unchanged caches are not rewritten with a fresh nonce
+	if _, _, err := GetOrGenerateEMachID("test-salt"); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := store.Load(); string(again) != string(data) {
+		t.Error("unchanged encrypted cache was rewritten")
+	}
+}
+
+func TestCacheEncryption_WrongKey(t *testing.T) {
+	store := useMemoryCacheStore(t)
+	useCacheEncryption(t, PassphraseKeyProvider("correct horse"))
+	if _, _, err := GetOrGenerateEMachID("test-salt"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := store.Load()
+
+	SetCacheEncryption(PassphraseKeyProvider("wrong"))
+	_, err := LoadCachedIDs()
+	if !errors.Is(err, ErrCacheDecrypt) || errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("LoadCachedIDs() with the wrong key expected ErrCacheDecrypt, got: %v", err)
+	}
+	if _, _, err := GetOrGenerateEMachID("test-salt"); !errors.Is(err, ErrCacheDecrypt) {
+		t.Errorf("GetOrGenerateEMachID() with the wrong key expected ErrCacheDecrypt, got: %v", err)
+	}
+
+	SetCacheEncryption(nil)
+	if _, err := LoadCachedIDs(); !errors.Is(err, ErrCacheDecrypt) {
+		t.Errorf("LoadCachedIDs() without a key expected ErrCacheDecrypt, got: %v", err)
+	}
+	if again, _ := store.Load(); string(again) != string(data) {
+		t.Error("encrypted cache was overwritten")
+	}
+}
+
+func TestCacheEncryption_PerCacheKDFSalt(t *testing.T) {
+	store := useMemoryCacheStore(t)
+	useCacheEncryption(t, PassphraseKeyProvider("correct horse"))
+	if _, _, err := GetOrGenerateEMachID("test-salt"); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := store.Load()
+
+	// The same passphrase on another installation uses another KDF salt
+	store.Clear()
+	SetCacheEncryption(PassphraseKeyProvider("correct horse"))
+	if _, _, err := GetOrGenerateEMachID("test-salt"); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := store.Load()
+
+	var a, b cacheEnvelope
+	if err := json.Unmarshal(first, &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(second, &b); err != nil {
+		t.Fatal(err)
+	}
+	if a.KDF != cachePassphraseKDF || len(a.KDFSalt) != cacheKDFSaltLength || a.Iterations != passphraseKeyIterations {
+		t.Errorf("envelope KDF parameters = %q, %d-byte salt, %d iterations", a.KDF, len(a.KDFSalt), a.Iterations)
+	}
+	if string(a.KDFSalt) == string(b.KDFSalt) {
+		t.Error("two caches encrypted with the same passphrase share a KDF salt")
+	}
+}
+
+func TestCacheEncryption_EncryptsPlaintextCache(t *testing.T) {
+	store := useMemoryCacheStore(t)
+	if err := SaveCachedIDs(&CachedMachineIDs{EMachID: "plain-emach"}); err != nil {
+		t.Fatal(err)
+	}
+
+	useCacheEncryption(t, PassphraseKeyProvider("correct horse"))
+	if cache, err := LoadCachedIDs(); err != nil || cache.EMachID != "plain-emach" {
+		t.Fatalf("LoadCachedIDs() = %+v, %v", cache, err)
+	}
+	if data, _ := store.Load(); strings.Contains(string(data), "plain-emach") {
+		t.Errorf("plaintext cache was not encrypted on load: %s", data)
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte("0123456789abcdef0123456789abcdef"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	provider := &FileKeyProvider{Path: path}
+	if key, err := provider.CacheKey(); err != nil || len(key) != 32 {
+		t.Errorf("CacheKey() = %d bytes, %v", len(key), err)
+	}
+
+	os.Chmod(path, 0644)
+	if _, err := provider.CacheKey(); !errors.Is(err, ErrInsecureCachePath) {
+		t.Errorf("CacheKey() on a readable key file expected ErrInsecureCachePath, got: %v", err)
+	}
+}
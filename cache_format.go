@@ -0,0 +1,163 @@
+package machid
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ================================================================================
+// Cache Encoding
+// ================================================================================
+//
+// All cache backends share this encoding. The application salt is never written
+// to the cache; a keyed verifier ("v1$<key>$<mac>", HMAC-SHA256 with a random
+// per-cache key) lets salt mismatches still be detected.
+
+// saltVerifierVersion prefixes salt verifiers
+const saltVerifierVersion = "v1"
+
+// newSaltVerifier returns a keyed verifier for salt.
+func newSaltVerifier(salt string) (string, error) {
+	key, err := generateRandomHex(16)
+	if err != nil {
+		return "", err
+	}
+	return saltVerifierVersion + "$" + key + "$" + saltVerifierMAC(key, salt), nil
+}
+
+// saltVerifierMAC computes the verifier MAC for salt under the hex key.
+func saltVerifierMAC(key, salt string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("machid salt verifier\x00"))
+	mac.Write([]byte(salt))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// MatchesSalt reports whether the cache was saved with the given salt.
+// A cache without a recorded salt matches any salt.
+func (c *CachedMachineIDs) MatchesSalt(salt string) bool {
+	if c.SaltVerifier == "" {
+		return true
+	}
+	parts := strings.Split(c.SaltVerifier, "$")
+	if len(parts) != 3 || parts[0] != saltVerifierVersion {
+		return false
+	}
+	return hmac.Equal([]byte(parts[2]), []byte(saltVerifierMAC(parts[1], salt)))
+}
+
+// cacheDocument is the encoded form of the whole cache (see cache_schema.go).
+type cacheDocument struct {
+	SchemaVersion int                          `json:"schema_version"`
+	Namespaces    map[string]*CachedMachineIDs `json:"namespaces"`
+}
+
+// newCacheDocument returns an empty document.
+func newCacheDocument() *cacheDocument {
+	return &cacheDocument{Namespaces: make(map[string]*CachedMachineIDs)}
+}
+
+// assignSalt records the salt an entry's reMachID was derived with. An empty
+// salt also drops the verifier of a previous salt, so the entry is sealed for
+// the empty salt (see sealReMachID).
+func (c *CachedMachineIDs) assignSalt(salt string) {
+	c.Salt = salt
+	if salt == "" {
+		c.SaltVerifier = ""
+	}
+}
+
+// prepareEntry replaces a set Salt with a salt verifier and seals the reMachID
+// with a MAC (see VerifyReMachID). An existing verifier that already matches is
+// kept so unchanged caches encode to identical bytes.
+func prepareEntry(cache *CachedMachineIDs) error {
+	sealReMachID(cache, cache.Salt)
+	if cache.Salt != "" && (cache.SaltVerifier == "" || !cache.MatchesSalt(cache.Salt)) {
+		verifier, err := newSaltVerifier(cache.Salt)
+		if err != nil {
+			return err
+		}
+		cache.SaltVerifier = verifier
+	}
+	clearString(&cache.Salt)
+	return nil
+}
+
+// encodeCacheDocument serializes the cache document.
+func encodeCacheDocument(doc *cacheDocument) ([]byte, error) {
+	out := newCacheDocument()
+	out.SchemaVersion = CacheSchemaVersion
+	for name, entry := range doc.Namespaces {
+		prepared := *entry
+		if err := prepareEntry(&prepared); err != nil {
+			return nil, err
+		}
+		out.Namespaces[name] = &prepared
+	}
+	return json.MarshalIndent(out, "", "  ")
+}
+
+// decodeCacheDocument parses an encoded cache document. Documents with an
+// older schema version are migrated, and plaintext salts are replaced by salt
+// verifiers; migrated reports whether either happened so the caller can
+// persist the new form. Errors are *CacheError values.
+func decodeCacheDocument(data []byte) (doc *cacheDocument, migrated bool, err error) {
+	obj, version, err := parseCacheObject(data)
+	if err != nil {
+		return nil, false, err
+	}
+	if version != CacheSchemaVersion {
+		if obj, err = migrateCacheObject(obj, version, CacheSchemaVersion); err != nil {
+			return nil, false, err
+		}
+		migrated = true
+	}
+
+	var namespaces map[string]json.RawMessage
+	if err := json.Unmarshal(obj["namespaces"], &namespaces); err != nil {
+		return nil, false, &CacheError{Op: "decode", Version: version, Err: fmt.Errorf("%w: %v", ErrCacheCorrupt, err)}
+	}
+
+	doc = newCacheDocument()
+	doc.SchemaVersion = CacheSchemaVersion
+	for name, entryData := range namespaces {
+		entry, entryMigrated, err := decodeEntry(entryData)
+		if err != nil {
+			return nil, false, &CacheError{Op: "decode", Version: version,
+				Err: fmt.Errorf("%w: namespace %q: %v", ErrCacheCorrupt, name, err)}
+		}
+		doc.Namespaces[name] = entry
+		migrated = migrated || entryMigrated
+	}
+	return doc, migrated, nil
+}
+
+// decodeEntry parses a single namespace entry, migrating a legacy plaintext
+// salt to a salt verifier and sealing the reMachID with it.
+func decodeEntry(data []byte) (cache *CachedMachineIDs, migrated bool, err error) {
+	type cachedIDs CachedMachineIDs // Drops methods, keeps field tags
+	var raw struct {
+		cachedIDs
+		LegacySalt string `json:"salt"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, false, err
+	}
+
+	cache = (*CachedMachineIDs)(&raw.cachedIDs)
+	if raw.LegacySalt != "" {
+		if cache.SaltVerifier == "" {
+			if cache.SaltVerifier, err = newSaltVerifier(raw.LegacySalt); err != nil {
+				return nil, false, err
+			}
+		}
+		sealReMachID(cache, raw.LegacySalt)
+		clearString(&raw.LegacySalt)
+		migrated = true
+	}
+	return cache, migrated, nil
+}
@@ -0,0 +1,62 @@
+package machid
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeCache_NoPlaintextSalt(t *testing.T) {
+	doc := newCacheDocument()
+	doc.Namespaces["app"] = &CachedMachineIDs{ReMachID: "remach", Salt: "super-secret-salt"}
+	data, err := encodeCacheDocument(doc)
+	if err != nil {
+		t.Fatalf("encodeCacheDocument() failed: %v", err)
+	}
+	if strings.Contains(string(data), "super-secret-salt") {
+		t.Errorf("encodeCacheDocument() persisted the plaintext salt: %s", data)
+	}
+
+	decoded, migrated, err := decodeCacheDocument(data)
+	if err != nil || migrated {
+		t.Fatalf("decodeCacheDocument() = %v, %v", migrated, err)
+	}
+	cache := decoded.Namespaces["app"]
+	if !cache.MatchesSalt("super-secret-salt") {
+		t.Error("MatchesSalt() rejected the original salt")
+	}
+	if cache.MatchesSalt("other-salt") {
+		t.Error("MatchesSalt() accepted a different salt")
+	}
+
+	// Re-encoding with the same salt keeps the verifier stable
+	cache.Salt = "super-secret-salt"
+	again, err := encodeCacheDocument(decoded)
+	if err != nil || string(again) != string(data) {
+		t.Errorf("encodeCacheDocument() changed an unchanged cache:\n%s\n%s", data, again)
+	}
+}
+
+func TestLoadCachedIDs_MigratesLegacySalt(t *testing.T) {
+	store := useMemoryCacheStore(t)
+	if err := store.Save([]byte(`{"remach_id":"remach","salt":"legacy-salt","action_count":3}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := LoadCachedIDs()
+	if err != nil {
+		t.Fatalf("LoadCachedIDs() failed: %v", err)
+	}
+	if cache.ReMachID != "remach" || cache.ActionCount != 3 || !cache.MatchesSalt("legacy-salt") {
+		t.Errorf("LoadCachedIDs() returned unexpected cache: %+v", cache)
+	}
+
+	data, _ := store.Load()
+	if strings.Contains(string(data), "legacy-salt") {
+		t.Errorf("legacy salt still stored after migration: %s", data)
+	}
+
+	remachid, fromCache, err := GetOrGenerateReMachID("legacy-salt")
+	if err != nil || !fromCache || remachid != "remach" {
+		t.Errorf("GetOrGenerateReMachID() = %q, %v, %v; expected migrated cache hit", remachid, fromCache, err)
+	}
+}
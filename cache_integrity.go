@@ -0,0 +1,104 @@
+package machid
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+)
+
+// ================================================================================
+// Cache Integrity
+// ================================================================================
+//
+// Anyone able to write the cache could otherwise plant another machine's
+// reMachID. Each cached reMachID therefore carries a MAC keyed from the
+// application salt and this host's machine-id. The machine-id is
+// world-readable, so the MAC is only as secret as the salt: it keeps out
+// users who do not know the application's salt. With the empty salt anyone
+// can recompute it, and such caches have no tamper protection. When running
+// as root, the cached value can also be re-verified against the hardware
+// (see CachePolicy), which does not rely on the salt.
+
+// ErrCacheTampered is returned when a cached reMachID fails its integrity check
+var ErrCacheTampered = errors.New("machid: cached reMachID failed integrity check")
+
+// cacheMACVersion prefixes reMachID MACs
+const cacheMACVersion = "v1"
+
+// cacheBindingFiles bind cache MACs to this host; the first readable one is used
+var cacheBindingFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// SetCacheReverify enables or disables re-verification of cached reMachIDs.
+// When enabled and the process runs as root, GetOrGenerateReMachID derives the
+// reMachID from the hardware and replaces a cached value that does not match.
+// This sets CachePolicy.RevalidateAsRoot.
+//
+// Parameters:
+//   - enabled: true to re-verify cached reMachIDs when root is available
+func SetCacheReverify(enabled bool) {
+	cachePolicyMu.Lock()
+	defer cachePolicyMu.Unlock()
+	cachePolicy.RevalidateAsRoot = enabled
+}
+
+// IsCacheReverify returns whether re-verification of cached reMachIDs is enabled.
+func IsCacheReverify() bool {
+	return GetCachePolicy().RevalidateAsRoot
+}
+
+// cacheBinding returns the host binding for cache MACs (empty if unavailable).
+func cacheBinding() string {
+	for _, path := range cacheBindingFiles {
+		if data, err := os.ReadFile(path); err == nil {
+			if id := strings.TrimSpace(string(data)); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// reMachIDMAC computes the MAC of remachid under the key derived from salt.
+func reMachIDMAC(salt, remachid string) string {
+	key := hmac.New(sha256.New, []byte(salt))
+	key.Write([]byte("machid cache key\x00"))
+	key.Write([]byte(cacheBinding()))
+
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write([]byte("machid remachid\x00"))
+	mac.Write([]byte(remachid))
+	return cacheMACVersion + "$" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sealReMachID sets the reMachID MAC if the salt is known and the MAC is
+// missing or stale. An empty salt is known for entries without a salt
+// verifier, which belong to the empty salt; for entries with a verifier it
+// means the salt is unknown and the MAC is left alone. A valid MAC is kept so
+// unchanged caches encode identically.
+func sealReMachID(cache *CachedMachineIDs, salt string) {
+	if cache.ReMachID == "" || (salt == "" && cache.SaltVerifier != "") {
+		return
+	}
+	if mac := reMachIDMAC(salt, cache.ReMachID); !hmac.Equal([]byte(cache.ReMachIDMAC), []byte(mac)) {
+		cache.ReMachIDMAC = mac
+	}
+}
+
+// VerifyReMachID checks the integrity of the cached reMachID against salt.
+// Returns a *CacheError wrapping ErrCacheTampered if the MAC is missing or
+// does not match, e.g. because the reMachID was edited or copied from
+// another machine. A cache without a reMachID verifies successfully. For the
+// empty salt the check only catches accidental edits: anyone can compute a
+// matching MAC.
+func (c *CachedMachineIDs) VerifyReMachID(salt string) error {
+	if c.ReMachID == "" {
+		return nil
+	}
+	if c.ReMachIDMAC == "" || !hmac.Equal([]byte(c.ReMachIDMAC), []byte(reMachIDMAC(salt, c.ReMachID))) {
+		return &CacheError{Op: "verify", Err: ErrCacheTampered}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package machid
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func useTempCacheBinding(t *testing.T, id string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "machine-id")
+	if err := os.WriteFile(path, []byte(id+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := cacheBindingFiles
+	cacheBindingFiles = []string{path}
+	t.Cleanup(func() { cacheBindingFiles = old })
+}
+
+func TestVerifyReMachID(t *testing.T) {
+	useTempCacheBinding(t, "host-a")
+
+	cache := &CachedMachineIDs{ReMachID: "remach"}
+	sealReMachID(cache, "salt")
+	if err := cache.VerifyReMachID("salt"); err != nil {
+		t.Errorf("VerifyReMachID() rejected a sealed reMachID: %v", err)
+	}
+	if err := cache.VerifyReMachID("other-salt"); !errors.Is(err, ErrCacheTampered) {
+		t.Errorf("VerifyReMachID() with a different salt expected ErrCacheTampered, got: %v", err)
+	}
+
+	edited := *cache
+	edited.ReMachID = "other-machine"
+	if err := edited.VerifyReMachID("salt"); !errors.Is(err, ErrCacheTampered) {
+		t.Errorf("VerifyReMachID() of an edited reMachID expected ErrCacheTampered, got: %v", err)
+	}
+
+	// An entry copied from another host does not verify
+	useTempCacheBinding(t, "host-b")
+	if err := cache.VerifyReMachID("salt"); !errors.Is(err, ErrCacheTampered) {
+		t.Errorf("VerifyReMachID() on another host expected ErrCacheTampered, got: %v", err)
+	}
+}
+
+func TestGetOrGenerateReMachID_Tampered(t *testing.T) {
+	store := useMemoryCacheStore(t)
+	useTempFallbackDir(t)
+	useTempLedger(t)
+
+	if err := SaveCachedIDs(&CachedMachineIDs{ReMachID: "genuine", Salt: "salt"}); err != nil {
+		t.Fatal(err)
+	}
+	remachid, fromCache, err := GetOrGenerateReMachID("salt")
+	if err != nil || !fromCache || remachid != "genuine" {
+		t.Fatalf("GetOrGenerateReMachID() = %q, %v, %v; expected sealed cache hit", remachid, fromCache, err)
+	}
+
+	data, _ := store.Load()
+	store.Save([]byte(strings.Replace(string(data), "genuine", "planted", 1)))
+
+	remachid, fromCache, err = GetOrGenerateReMachID("salt")
+	if fromCache || remachid == "planted" {
+		t.Errorf("GetOrGenerateReMachID() returned the planted reMachID")
+	}
+	if os.Geteuid() != 0 {
+		var cacheErr *CacheError
+		if !errors.As(err, &cacheErr) || !errors.Is(err, ErrCacheTampered) {
+			t.Errorf("GetOrGenerateReMachID() expected CacheError with ErrCacheTampered, got: %v", err)
+		}
+	} else if err != nil {
+		t.Errorf("GetOrGenerateReMachID() as root should regenerate, got: %v", err)
+	}
+}
+
+func TestGetOrGenerateReMachID_Reverify(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	useMemoryCacheStore(t)
+	useTempFallbackDir(t)
+	useTempLedger(t)
+
+	// A correctly sealed value that does not belong to this machine
+	if err := SaveCachedIDs(&CachedMachineIDs{ReMachID: "stale", Salt: "salt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	SetCacheReverify(true)
+	defer SetCacheReverify(false)
+
+	remachid, fromCache, err := GetOrGenerateReMachID("salt")
+	if err != nil || fromCache || remachid == "stale" {
+		t.Fatalf("GetOrGenerateReMachID() = %q, %v, %v; expected a re-derived reMachID", remachid, fromCache, err)
+	}
+	again, fromCache, err := GetOrGenerateReMachID("salt")
+	if err != nil || !fromCache || again != remachid {
+		t.Errorf("GetOrGenerateReMachID() = %q, %v, %v; expected verified cache hit", again, fromCache, err)
+	}
+}
+
+func TestGetOrGenerateReMachID_EmptySalt(t *testing.T) {
+	useMemoryCacheStore(t)
+	useTempFallbackDir(t)
+	useTempLedger(t)
+
+	if os.Geteuid() == 0 {
+		first, _, err := GetOrGenerateReMachID("")
+		if err != nil {
+			t.Fatalf("GetOrGenerateReMachID(\"\") failed: %v", err)
+		}
+		again, fromCache, err := GetOrGenerateReMachID("")
+		if err != nil || !fromCache || again != first {
+			t.Errorf("GetOrGenerateReMachID(\"\") = %q, %v, %v; expected cache hit", again, fromCache, err)
+		}
+		return
+	}
+
+	if err := SaveCachedIDs(&CachedMachineIDs{ReMachID: "genuine"}); err != nil {
+		t.Fatal(err)
+	}
+	remachid, fromCache, err := GetOrGenerateReMachID("")
+	if err != nil || !fromCache || remachid != "genuine" {
+		t.Errorf("GetOrGenerateReMachID(\"\") = %q, %v, %v; expected sealed cache hit", remachid, fromCache, err)
+	}
+}
+
+func TestSealReMachID_UnknownSalt(t *testing.T) {
+	useTempCacheBinding(t, "host-a")
+
+	cache := &CachedMachineIDs{ReMachID: "remach", Salt: "salt"}
+	if err := prepareEntry(cache); err != nil {
+		t.Fatal(err)
+	}
+	// Updates that do not know the salt must keep the salted MAC
+	sealReMachID(cache, "")
+	if err := cache.VerifyReMachID("salt"); err != nil {
+		t.Errorf("VerifyReMachID() after an update without salt failed: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package machid
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ================================================================================
+// Cache Path Resolution and Hardening
+// ================================================================================
+//
+// The per-user cache lives in the home directory of the user who invoked the
+// process - also when it runs as root through sudo, doas or pkexec. Cache
+// directories are created 0700 and files 0600, insecure permissions on existing
+// files are repaired, and symlinks planted in the cache path are refused.
+
+// ErrInsecureCachePath is returned when the cache path contains a symlink or is
+// owned by an unexpected user
+var ErrInsecureCachePath = errors.New("machid: insecure cache path")
+
+// invokingUser returns the unprivileged user who ran the process through sudo,
+// doas or pkexec, or nil if the process is not running elevated.
+func invokingUser() *user.User {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+
+	lookups := []struct {
+		env    string
+		lookup func(string) (*user.User, error)
+	}{
+		{"SUDO_UID", user.LookupId},
+		{"SUDO_USER", user.Lookup},
+		{"DOAS_USER", user.Lookup},
+		{"PKEXEC_UID", user.LookupId},
+	}
+	for _, l := range lookups {
+		value := os.Getenv(l.env)
+		if value == "" || value == "0" || value == "root" {
+			continue
+		}
+		if u, err := l.lookup(value); err == nil {
+			return u
+		}
+	}
+	return nil
+}
+
+// cacheOwner returns the UID and GID that should own cache files: the
+// invoking user when running elevated, otherwise the current user.
+func cacheOwner() (uid, gid int) {
+	if u := invokingUser(); u != nil {
+		uid, uidErr := strconv.Atoi(u.Uid)
+		gid, gidErr := strconv.Atoi(u.Gid)
+		if uidErr == nil && gidErr == nil {
+			return uid, gid
+		}
+	}
+	return os.Geteuid(), os.Getegid()
+}
+
+// getCacheHome returns the home directory the per-user cache lives in.
+func getCacheHome() (string, bool) {
+	if u := invokingUser(); u != nil {
+		if _, err := os.Stat(u.HomeDir); u.HomeDir != "" && err == nil {
+			return u.HomeDir, true
+		}
+		return "", false
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return "", false
+	}
+	return home, true
+}
+
+// getCacheDir returns the per-user cache directory. If no home directory is
+// available, a per-UID directory in the system temp directory is used.
+func getCacheDir() string {
+	if home, ok := getCacheHome(); ok {
+		return filepath.Join(home, cacheSubDir)
+	}
+	uid, _ := cacheOwner()
+	return filepath.Join(os.TempDir(), fmt.Sprintf("machid-%d", uid))
+}
+
+// getCachePath returns the full path to the cache file
+func getCachePath() string {
+	return filepath.Join(getCacheDir(), cacheFile)
+}
+
+// chownToCacheOwner hands the given paths to the invoking user when running
+// elevated, so the user can read them without elevated privileges.
+func chownToCacheOwner(paths ...string) {
+	if os.Geteuid() != 0 {
+		return
+	}
+	uid, gid := cacheOwner()
+	if uid == 0 {
+		return
+	}
+	for _, path := range paths {
+		os.Lchown(path, uid, gid)
+	}
+}
+
+// checkCacheFileInfo validates an existing cache path entry: it must not be a
+// symlink and must be owned by the cache owner or root.
+func checkCacheFileInfo(path string, fi os.FileInfo) error {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%w: %s is a symlink", ErrInsecureCachePath, path)
+	}
+	if owner, ok := fileOwner(fi); ok {
+		expected, _ := cacheOwner()
+		if owner != expected && owner != 0 && owner != os.Geteuid() {
+			return fmt.Errorf("%w: %s is owned by uid %d", ErrInsecureCachePath, path, owner)
+		}
+	}
+	return nil
+}
+
+// repairPermissions removes group/other access from an existing cache entry.
+func repairPermissions(path string, fi os.FileInfo, perm os.FileMode) {
+	if fi.Mode().Perm()&0077 == 0 {
+		return
+	}
+	if IsNoWriteMode() {
+		logWarning(fmt.Sprintf("WARNING: machid - Insecure permissions %04o on %s (not repaired in no-write mode)", fi.Mode().Perm(), path))
+		return
+	}
+	logWarning(fmt.Sprintf("WARNING: machid - Insecure permissions %04o on %s, repairing to %04o", fi.Mode().Perm(), path, perm))
+	if err := os.Chmod(path, perm); err != nil {
+		logWarning(fmt.Sprintf("WARNING: machid - Failed to repair permissions on %s: %v", path, err))
+	}
+}
+
+// secureCacheDir creates the directories in rel below the trusted root
+// (0700, owned by the cache owner), refusing symlinks along the way. The
+// permissions of the final directory are repaired if they are too open.
+func secureCacheDir(root, rel string) (string, error) {
+	dir := root
+	parts := strings.Split(filepath.Clean(rel), string(filepath.Separator))
+	for i, part := range parts {
+		dir = filepath.Join(dir, part)
+
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+				return "", err
+			}
+			chownToCacheOwner(dir)
+			fi, err = os.Lstat(dir)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if err := checkCacheFileInfo(dir, fi); err != nil {
+			return "", err
+		}
+		if !fi.IsDir() {
+			return "", fmt.Errorf("%w: %s is not a directory", ErrInsecureCachePath, dir)
+		}
+		if i == len(parts)-1 {
+			repairPermissions(dir, fi, 0700)
+		}
+	}
+	return dir, nil
+}
+
+// checkCacheFile validates an existing cache file and repairs its permissions.
+// A missing file is not an error.
+func checkCacheFile(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := checkCacheFileInfo(path, fi); err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%w: %s is not a regular file", ErrInsecureCachePath, path)
+	}
+	repairPermissions(path, fi, 0600)
+	return nil
+}
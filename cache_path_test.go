@@ -0,0 +1,98 @@
+package machid
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInvokingUser_AsRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	for _, env := range []string{"SUDO_UID", "SUDO_USER", "DOAS_USER", "PKEXEC_UID"} {
+		t.Setenv(env, "")
+	}
+
+	if u := invokingUser(); u != nil {
+		t.Errorf("invokingUser() without elevation variables = %v, expected nil", u.Username)
+	}
+
+	cases := map[string]string{
+		"SUDO_UID":   "65534",
+		"DOAS_USER":  "nobody",
+		"PKEXEC_UID": "65534",
+	}
+	for env, value := range cases {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+			u := invokingUser()
+			if u == nil || u.Uid != "65534" {
+				t.Errorf("invokingUser() with %s=%s = %v, expected uid 65534", env, value, u)
+			}
+		})
+	}
+}
+
+func TestFileCacheStore_Permissions(t *testing.T) {
+	silenceLogger(t)
+
+	dir := filepath.Join(t.TempDir(), "machid")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "cache.json")
+	store := NewFileCacheStore(path)
+
+	if err := store.Save([]byte("{}")); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+	if fi, _ := os.Stat(dir); fi.Mode().Perm() != 0700 {
+		t.Errorf("cache directory mode = %04o, expected 0700", fi.Mode().Perm())
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Errorf("cache file mode = %04o, expected 0600", fi.Mode().Perm())
+	}
+
+	// Insecure permissions on an existing cache are repaired on load
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Errorf("cache file mode after Load() = %04o, expected 0600", fi.Mode().Perm())
+	}
+}
+
+func TestFileCacheStore_RefusesSymlinks(t *testing.T) {
+	base := t.TempDir()
+	target := filepath.Join(base, "target.json")
+	if err := os.WriteFile(target, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Symlinked cache file
+	link := filepath.Join(base, "cache.json")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	store := NewFileCacheStore(link)
+	if _, err := store.Load(); !errors.Is(err, ErrInsecureCachePath) {
+		t.Errorf("Load() of symlinked cache expected ErrInsecureCachePath, got: %v", err)
+	}
+	if err := store.Save([]byte("{}")); !errors.Is(err, ErrInsecureCachePath) {
+		t.Errorf("Save() over symlinked cache expected ErrInsecureCachePath, got: %v", err)
+	}
+
+	// Symlinked cache directory
+	if err := os.Symlink(t.TempDir(), filepath.Join(base, "linkdir")); err != nil {
+		t.Fatal(err)
+	}
+	store = NewFileCacheStore(filepath.Join(base, "linkdir", "cache.json"))
+	if err := store.Save([]byte("{}")); !errors.Is(err, ErrInsecureCachePath) {
+		t.Errorf("Save() into symlinked directory expected ErrInsecureCachePath, got: %v", err)
+	}
+}
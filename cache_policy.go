@@ -0,0 +1,115 @@
+package machid
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ================================================================================
+// Cache Expiry and Revalidation
+// ================================================================================
+//
+// Cached reMachIDs record when they were last derived from the hardware
+// (VerifiedAt) and when they expire (ExpiresAt). The CachePolicy decides how
+// long a cached reMachID may be trusted without root and whether it is
+// re-derived whenever root is available.
+
+// ErrCacheExpired is returned when a cached reMachID is older than the policy
+// allows and cannot be revalidated without root privileges
+var ErrCacheExpired = errors.New("machid: cached reMachID has expired")
+
+// CachePolicy controls how cached reMachIDs are trusted.
+type CachePolicy struct {
+	// MaxAge is how long a cached reMachID is trusted after it was last
+	// derived from the hardware. Zero means no limit.
+	MaxAge time.Duration
+
+	// RevalidateAsRoot re-derives the cached reMachID whenever the process
+	// runs as root, replacing it if the hardware has changed.
+	RevalidateAsRoot bool
+
+	// AlwaysFresh ignores cached reMachIDs and always derives a new one.
+	// This requires root on every call.
+	AlwaysFresh bool
+}
+
+// CacheStatus describes where a reMachID returned by GetOrGenerateReMachIDWithStatus came from.
+type CacheStatus int
+
+const (
+	// CacheStatusRefreshed means the reMachID was newly derived from the
+	// hardware, and either nothing was cached or the cached value differed
+	CacheStatusRefreshed CacheStatus = iota
+
+	// CacheStatusTrusted means the cached reMachID was returned without
+	// checking it against the hardware
+	CacheStatusTrusted
+
+	// CacheStatusRevalidated means the cached reMachID was re-derived from the
+	// hardware and still matched
+	CacheStatusRevalidated
+)
+
+// String returns the name of the cache status.
+func (s CacheStatus) String() string {
+	switch s {
+	case CacheStatusRefreshed:
+		return "refreshed"
+	case CacheStatusTrusted:
+		return "trusted"
+	case CacheStatusRevalidated:
+		return "revalidated"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	// cachePolicy configured with SetCachePolicy
+	cachePolicy   CachePolicy
+	cachePolicyMu sync.RWMutex
+)
+
+// SetCachePolicy sets how cached reMachIDs are trusted and revalidated.
+// The default policy trusts cached reMachIDs indefinitely.
+//
+// Parameters:
+//   - policy: The cache policy to use
+func SetCachePolicy(policy CachePolicy) {
+	cachePolicyMu.Lock()
+	defer cachePolicyMu.Unlock()
+	cachePolicy = policy
+}
+
+// GetCachePolicy returns the current cache policy.
+func GetCachePolicy() CachePolicy {
+	cachePolicyMu.RLock()
+	defer cachePolicyMu.RUnlock()
+	return cachePolicy
+}
+
+// expired reports whether the cached reMachID may no longer be trusted at now.
+// Entries written before VerifiedAt existed are aged from CreatedAt.
+func (p CachePolicy) expired(cache *CachedMachineIDs, now time.Time) bool {
+	if cache.ExpiresAt != 0 && now.Unix() >= cache.ExpiresAt {
+		return true
+	}
+	if p.MaxAge <= 0 {
+		return false
+	}
+	verified := cache.VerifiedAt
+	if verified == 0 {
+		verified = cache.CreatedAt
+	}
+	return verified == 0 || now.Sub(time.Unix(verified, 0)) >= p.MaxAge
+}
+
+// stamp records that the cached reMachID was derived from the hardware at now.
+func (p CachePolicy) stamp(cache *CachedMachineIDs, now time.Time) {
+	cache.VerifiedAt = now.Unix()
+	cache.ExpiresAt = 0
+	if p.MaxAge > 0 {
+		cache.ExpiresAt = now.Add(p.MaxAge).Unix()
+	}
+}
@@ -0,0 +1,93 @@
+package machid
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func useCachePolicy(t *testing.T, policy CachePolicy) {
+	t.Helper()
+	SetCachePolicy(policy)
+	t.Cleanup(func() { SetCachePolicy(CachePolicy{}) })
+}
+
+func TestCachePolicy_Expired(t *testing.T) {
+	now := time.Now()
+	hourAgo := now.Add(-time.Hour).Unix()
+
+	tests := []struct {
+		name    string
+		policy  CachePolicy
+		cache   CachedMachineIDs
+		expired bool
+	}{
+		{"no max age", CachePolicy{}, CachedMachineIDs{VerifiedAt: hourAgo}, false},
+		{"within max age", CachePolicy{MaxAge: 2 * time.Hour}, CachedMachineIDs{VerifiedAt: hourAgo}, false},
+		{"past max age", CachePolicy{MaxAge: time.Minute}, CachedMachineIDs{VerifiedAt: hourAgo}, true},
+		{"legacy entry aged from CreatedAt", CachePolicy{MaxAge: time.Minute}, CachedMachineIDs{CreatedAt: hourAgo}, true},
+		{"unknown age", CachePolicy{MaxAge: time.Minute}, CachedMachineIDs{}, true},
+		{"recorded expiry", CachePolicy{}, CachedMachineIDs{VerifiedAt: hourAgo, ExpiresAt: now.Unix() - 1}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.expired(&tt.cache, now); got != tt.expired {
+			t.Errorf("%s: expired() = %v, expected %v", tt.name, got, tt.expired)
+		}
+	}
+}
+
+func TestGetOrGenerateReMachIDWithStatus_Expired(t *testing.T) {
+	useMemoryCacheStore(t)
+	useTempFallbackDir(t)
+	useTempLedger(t)
+	useCachePolicy(t, CachePolicy{MaxAge: time.Hour})
+
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	if err := SaveCachedIDs(&CachedMachineIDs{ReMachID: "stale", Salt: "salt", VerifiedAt: old}); err != nil {
+		t.Fatal(err)
+	}
+
+	remachid, status, err := GetOrGenerateReMachIDWithStatus("salt")
+	if os.Geteuid() != 0 {
+		if !errors.Is(err, ErrCacheExpired) {
+			t.Errorf("GetOrGenerateReMachIDWithStatus() expected ErrCacheExpired, got: %q, %v, %v", remachid, status, err)
+		}
+		return
+	}
+	if err != nil || status != CacheStatusRefreshed || remachid == "stale" {
+		t.Fatalf("GetOrGenerateReMachIDWithStatus() = %q, %v, %v; expected refreshed", remachid, status, err)
+	}
+	cache, err := LoadCachedIDs()
+	if err != nil || cache.ExpiresAt <= time.Now().Unix() || cache.VerifiedAt < old {
+		t.Errorf("revalidation metadata not updated: %+v, %v", cache, err)
+	}
+}
+
+func TestGetOrGenerateReMachIDWithStatus_AsRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	useMemoryCacheStore(t)
+	useTempFallbackDir(t)
+	useTempLedger(t)
+
+	remachid, status, err := GetOrGenerateReMachIDWithStatus("salt")
+	if err != nil || status != CacheStatusRefreshed {
+		t.Fatalf("GetOrGenerateReMachIDWithStatus() = %q, %v, %v; expected refreshed", remachid, status, err)
+	}
+	if _, status, _ = GetOrGenerateReMachIDWithStatus("salt"); status != CacheStatusTrusted {
+		t.Errorf("default policy: status = %v, expected trusted", status)
+	}
+
+	useCachePolicy(t, CachePolicy{RevalidateAsRoot: true})
+	again, status, err := GetOrGenerateReMachIDWithStatus("salt")
+	if err != nil || status != CacheStatusRevalidated || again != remachid {
+		t.Errorf("RevalidateAsRoot: = %q, %v, %v; expected revalidated %q", again, status, err, remachid)
+	}
+
+	useCachePolicy(t, CachePolicy{AlwaysFresh: true})
+	if _, status, _ = GetOrGenerateReMachIDWithStatus("salt"); status != CacheStatusRefreshed {
+		t.Errorf("AlwaysFresh: status = %v, expected refreshed", status)
+	}
+}
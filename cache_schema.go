@@ -0,0 +1,184 @@
+package machid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ================================================================================
+// Cache Schema Versions and Migrations
+// ================================================================================
+//
+// The cache document carries a schema_version. Older documents are migrated
+// forward on load (and persisted in the new form on the next write); documents
+// written by a newer library version are refused instead of being
+// misinterpreted or overwritten with an older format.
+//
+// Schema history:
+//   - 1: a single bare CachedMachineIDs object (no version field)
+//   - 2: {"schema_version": 2, "namespaces": {"<name>": CachedMachineIDs}}
+
+// CacheSchemaVersion is the cache schema version written by this library
+const CacheSchemaVersion = 2
+
+// Cache errors
+var (
+	// ErrCacheCorrupt is returned when the cache cannot be parsed
+	ErrCacheCorrupt = errors.New("machid: cache is corrupt")
+
+	// ErrCacheVersionTooNew is returned when the cache was written by a newer
+	// library version; it is neither read nor overwritten
+	ErrCacheVersionTooNew = errors.New("machid: cache schema version is newer than supported")
+
+	// ErrCacheMigration is returned when a cache cannot be migrated to the
+	// requested schema version
+	ErrCacheMigration = errors.New("machid: cache schema migration failed")
+)
+
+// CacheError describes a cache that could not be read or written.
+// Use errors.Is with ErrCacheCorrupt, ErrCacheVersionTooNew or
+// ErrCacheMigration to classify it.
+type CacheError struct {
+	Op      string // Operation that failed, e.g. "decode" or "migrate"
+	Version int    // Schema version of the stored cache (0 if unknown)
+	Err     error  // Underlying error
+}
+
+// Error implements the error interface.
+func (e *CacheError) Error() string {
+	if e.Version != 0 {
+		return fmt.Sprintf("machid: cache %s (schema version %d): %v", e.Op, e.Version, e.Err)
+	}
+	return fmt.Sprintf("machid: cache %s: %v", e.Op, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *CacheError) Unwrap() error {
+	return e.Err
+}
+
+// cacheObject is a cache document as a generic JSON object, which is what
+// migrations operate on so they do not depend on the current Go types.
+type cacheObject map[string]json.RawMessage
+
+// cacheMigration converts a document between schema version from and from+1.
+type cacheMigration struct {
+	from int
+	up   func(cacheObject) (cacheObject, error)
+	down func(cacheObject) (cacheObject, error)
+}
+
+// cacheMigrations lists the migrations in version order.
+var cacheMigrations = []cacheMigration{
+	{
+		from: 1,
+		// Move the bare entry into the default namespace
+		up: func(obj cacheObject) (cacheObject, error) {
+			entry, err := json.Marshal(obj)
+			if err != nil {
+				return nil, err
+			}
+			namespaces, err := json.Marshal(map[string]json.RawMessage{DefaultCacheNamespace: entry})
+			if err != nil {
+				return nil, err
+			}
+			return cacheObject{"namespaces": namespaces}, nil
+		},
+		// Keep the default (or only) namespace as the bare entry
+		down: func(obj cacheObject) (cacheObject, error) {
+			var namespaces map[string]cacheObject
+			if err := json.Unmarshal(obj["namespaces"], &namespaces); err != nil {
+				return nil, err
+			}
+			if entry, ok := namespaces[DefaultCacheNamespace]; ok && len(namespaces) == 1 {
+				return entry, nil
+			}
+			if len(namespaces) == 1 {
+				for _, entry := range namespaces {
+					return entry, nil
+				}
+			}
+			return nil, fmt.Errorf("schema version 1 holds a single namespace, cache has %d", len(namespaces))
+		},
+	},
+}
+
+// cacheObjectVersion returns the schema version of a cache object.
+func cacheObjectVersion(obj cacheObject) (int, error) {
+	if raw, ok := obj["schema_version"]; ok {
+		var version int
+		if err := json.Unmarshal(raw, &version); err != nil || version < 1 {
+			return 0, fmt.Errorf("%w: invalid schema_version %s", ErrCacheCorrupt, raw)
+		}
+		return version, nil
+	}
+	if _, ok := obj["namespaces"]; ok {
+		return 2, nil
+	}
+	return 1, nil
+}
+
+// parseCacheObject parses data and determines its schema version.
+func parseCacheObject(data []byte) (cacheObject, int, error) {
+	var obj cacheObject
+	if err := json.Unmarshal(data, &obj); err != nil || obj == nil {
+		if err == nil {
+			err = errors.New("not a JSON object")
+		}
+		return nil, 0, &CacheError{Op: "decode", Err: fmt.Errorf("%w: %v", ErrCacheCorrupt, err)}
+	}
+	version, err := cacheObjectVersion(obj)
+	if err != nil {
+		return nil, 0, &CacheError{Op: "decode", Err: err}
+	}
+	return obj, version, nil
+}
+
+// migrateCacheObject converts obj from schema version from to version to.
+func migrateCacheObject(obj cacheObject, from, to int) (cacheObject, error) {
+	if from > CacheSchemaVersion {
+		return nil, &CacheError{Op: "migrate", Version: from, Err: ErrCacheVersionTooNew}
+	}
+	if to < 1 || to > CacheSchemaVersion {
+		return nil, &CacheError{Op: "migrate", Version: from,
+			Err: fmt.Errorf("%w: unsupported target version %d", ErrCacheMigration, to)}
+	}
+
+	var err error
+	for version := from; version != to; {
+		if version < to {
+			obj, err = cacheMigrations[version-1].up(obj)
+			version++
+		} else {
+			obj, err = cacheMigrations[version-2].down(obj)
+			version--
+		}
+		if err != nil {
+			return nil, &CacheError{Op: "migrate", Version: from, Err: fmt.Errorf("%w: %v", ErrCacheMigration, err)}
+		}
+		delete(obj, "schema_version")
+		if version > 1 {
+			obj["schema_version"] = json.RawMessage(fmt.Sprint(version))
+		}
+	}
+	return obj, nil
+}
+
+// MigrateCacheData converts encoded cache data to the given schema version.
+// Forward migrations are lossless. Backward migrations fail with
+// ErrCacheMigration if the older schema cannot represent the data (for example
+// several namespaces in schema version 1).
+//
+// This is intended for tooling, e.g. preparing a cache for an older library
+// version; the library itself migrates caches automatically.
+func MigrateCacheData(data []byte, toVersion int) ([]byte, error) {
+	obj, version, err := parseCacheObject(data)
+	if err != nil {
+		return nil, err
+	}
+	if obj, err = migrateCacheObject(obj, version, toVersion); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(obj, "", "  ")
+}
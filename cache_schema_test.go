@@ -0,0 +1,83 @@
+package machid
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestMigrateCacheData_RoundTrip(t *testing.T) {
+	legacy := []byte(`{"remach_id":"re","emach_id":"em","action_count":3}`)
+
+	upgraded, err := MigrateCacheData(legacy, CacheSchemaVersion)
+	if err != nil {
+		t.Fatalf("MigrateCacheData() up failed: %v", err)
+	}
+	var doc struct {
+		SchemaVersion int                        `json:"schema_version"`
+		Namespaces    map[string]json.RawMessage `json:"namespaces"`
+	}
+	if err := json.Unmarshal(upgraded, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.SchemaVersion != 2 || doc.Namespaces[DefaultCacheNamespace] == nil {
+		t.Fatalf("MigrateCacheData() up produced %s", upgraded)
+	}
+
+	downgraded, err := MigrateCacheData(upgraded, 1)
+	if err != nil {
+		t.Fatalf("MigrateCacheData() down failed: %v", err)
+	}
+	var entry CachedMachineIDs
+	if err := json.Unmarshal(downgraded, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.ReMachID != "re" || entry.EMachID != "em" || entry.ActionCount != 3 {
+		t.Errorf("MigrateCacheData() down produced %s", downgraded)
+	}
+}
+
+func TestMigrateCacheData_LossyDowngrade(t *testing.T) {
+	data := []byte(`{"schema_version":2,"namespaces":{"a":{"remach_id":"1"},"b":{"remach_id":"2"}}}`)
+	if _, err := MigrateCacheData(data, 1); !errors.Is(err, ErrCacheMigration) {
+		t.Errorf("MigrateCacheData() expected ErrCacheMigration, got: %v", err)
+	}
+}
+
+func TestCache_VersionTooNew(t *testing.T) {
+	store := useMemoryCacheStore(t)
+	newer := []byte(`{"schema_version":99,"namespaces":{}}`)
+	store.Save(newer)
+
+	var cacheErr *CacheError
+	if _, err := LoadCachedIDs(); !errors.As(err, &cacheErr) || !errors.Is(err, ErrCacheVersionTooNew) || cacheErr.Version != 99 {
+		t.Errorf("LoadCachedIDs() expected CacheError with ErrCacheVersionTooNew, got: %v", err)
+	}
+	if err := SaveCachedIDs(&CachedMachineIDs{EMachID: "em"}); !errors.Is(err, ErrCacheVersionTooNew) {
+		t.Errorf("SaveCachedIDs() expected ErrCacheVersionTooNew, got: %v", err)
+	}
+	if _, _, err := GetOrGenerateEMachID("test-salt"); !errors.Is(err, ErrCacheVersionTooNew) {
+		t.Errorf("GetOrGenerateEMachID() expected ErrCacheVersionTooNew, got: %v", err)
+	}
+	if data, _ := store.Load(); string(data) != string(newer) {
+		t.Errorf("newer cache was overwritten: %s", data)
+	}
+}
+
+func TestCache_CorruptRegenerated(t *testing.T) {
+	store := useMemoryCacheStore(t)
+	store.Save([]byte(`{"namespaces":`))
+
+	if _, err := LoadCachedIDs(); !errors.Is(err, ErrCacheCorrupt) {
+		t.Errorf("LoadCachedIDs() expected ErrCacheCorrupt, got: %v", err)
+	}
+
+	emachid, fromCache, err := GetOrGenerateEMachID("test-salt")
+	if err != nil || fromCache || emachid == "" {
+		t.Fatalf("GetOrGenerateEMachID() = %q, %v, %v", emachid, fromCache, err)
+	}
+	cached, err := LoadCachedIDs()
+	if err != nil || cached.EMachID != emachid {
+		t.Errorf("corrupt cache was not replaced: %+v, %v", cached, err)
+	}
+}
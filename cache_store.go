@@ -0,0 +1,301 @@
+package machid
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ================================================================================
+// Cache Storage Backends
+// ================================================================================
+//
+// LoadCachedIDs, SaveCachedIDs and every function built on them (GetOrGenerate*,
+// RotateEMachID, IncrementActionCount) persist the cache through a CacheStore.
+// Stores deal in opaque encoded bytes, so every backend gets the same encoding
+// and the library stays in charge of the cache format.
+
+// CacheStore persists the encoded machine ID cache.
+// Implementations must be safe for concurrent use.
+type CacheStore interface {
+	// Load returns the stored cache data. It must return an error wrapping
+	// fs.ErrNotExist if nothing has been stored.
+	Load() ([]byte, error)
+
+	// Save replaces the stored cache data.
+	Save(data []byte) error
+
+	// Clear removes the stored cache data. Clearing an empty store is not an error.
+	Clear() error
+}
+
+// CacheLocker is implemented by stores that support cross-process locking.
+// UpdateCachedIDs and SaveCachedIDs hold the lock for the whole transaction.
+type CacheLocker interface {
+	// LockCache blocks until an exclusive lock on the store is acquired and
+	// returns a function that releases it.
+	LockCache() (unlock func(), err error)
+}
+
+var (
+	// cacheTxMu serializes cache transactions within the process
+	cacheTxMu sync.Mutex
+
+	// cacheStore is the store configured with SetCacheStore (nil means default)
+	cacheStore   CacheStore
+	cacheStoreMu sync.RWMutex
+
+	// defaultCacheStore is the per-user cache.json store
+	defaultCacheStore = &FileCacheStore{}
+
+	// noWriteCacheStore replaces file stores while no-write mode is enabled
+	noWriteCacheStore = NewMemoryCacheStore()
+)
+
+// SetCacheStore sets the backend used to persist cached machine IDs.
+// Pass nil to restore the default file store (~/.config/machid/cache.json).
+//
+// In no-write mode, FileCacheStore backends are transparently replaced by a
+// process-wide in-memory store. Other stores are used as configured; it is the
+// caller's responsibility to ensure they do not write to disk.
+func SetCacheStore(store CacheStore) {
+	cacheStoreMu.Lock()
+	defer cacheStoreMu.Unlock()
+	cacheStore = store
+}
+
+// GetCacheStore returns the configured cache backend.
+func GetCacheStore() CacheStore {
+	cacheStoreMu.RLock()
+	defer cacheStoreMu.RUnlock()
+	if cacheStore == nil {
+		return defaultCacheStore
+	}
+	return cacheStore
+}
+
+// activeCacheStore returns the store cache operations should use, taking
+// no-write mode into account.
+func activeCacheStore() CacheStore {
+	store := GetCacheStore()
+	if _, isFile := store.(*FileCacheStore); isFile && IsNoWriteMode() {
+		return noWriteCacheStore
+	}
+	return store
+}
+
+// lockCacheStore acquires the process-wide transaction lock and, if the store
+// supports it, the store's cross-process lock.
+func lockCacheStore(store CacheStore) (unlock func(), err error) {
+	cacheTxMu.Lock()
+	locker, ok := store.(CacheLocker)
+	if !ok {
+		return cacheTxMu.Unlock, nil
+	}
+
+	storeUnlock, err := locker.LockCache()
+	if err != nil {
+		cacheTxMu.Unlock()
+		return nil, fmt.Errorf("machid: failed to lock cache: %w", err)
+	}
+	return func() {
+		storeUnlock()
+		cacheTxMu.Unlock()
+	}, nil
+}
+
+// FileCacheStore stores the cache in a JSON file. Writes are atomic (temporary
+// file plus rename) and transactions take an advisory lock on a ".lock" file
+// next to the cache, so concurrent processes never lose updates or observe a
+// partially written cache.
+type FileCacheStore struct {
+	// Path is the cache file. If empty, the per-user default
+	// (~/.config/machid/cache.json, resolved at each call) is used.
+	Path string
+}
+
+// NewFileCacheStore returns a store backed by the file at path.
+// Pass an empty path to use the per-user default location.
+func NewFileCacheStore(path string) *FileCacheStore {
+	return &FileCacheStore{Path: path}
+}
+
+// path returns the cache file path.
+func (s *FileCacheStore) path() string {
+	if s.Path != "" {
+		return s.Path
+	}
+	return getCachePath()
+}
+
+// prepareDir creates and validates the cache directory. For the default
+// location the directories below the home directory are checked; for a custom
+// Path only the file's own directory is.
+func (s *FileCacheStore) prepareDir() (string, error) {
+	if s.Path == "" {
+		if home, ok := getCacheHome(); ok {
+			return secureCacheDir(home, cacheSubDir)
+		}
+	}
+	dir := filepath.Dir(s.path())
+	return secureCacheDir(filepath.Dir(dir), filepath.Base(dir))
+}
+
+// Load reads the cache file. Symlinks are refused and insecure permissions
+// are repaired.
+func (s *FileCacheStore) Load() ([]byte, error) {
+	cachePath := s.path()
+	if err := checkCacheFile(cachePath); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(cachePath, os.O_RDONLY|oNoFollow, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// Save writes the cache file with 0600 permissions.
+// When running elevated, it fixes ownership so the real user can read the file.
+func (s *FileCacheStore) Save(data []byte) error {
+	if err := checkWritable(); err != nil {
+		return err
+	}
+
+	if _, err := s.prepareDir(); err != nil {
+		return err
+	}
+
+	cachePath := s.path()
+	if err := checkCacheFile(cachePath); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(cachePath, data, 0600); err != nil {
+		return err
+	}
+
+	chownToCacheOwner(cachePath)
+	return nil
+}
+
+// LockCache takes an exclusive advisory lock on the cache's lock file.
+func (s *FileCacheStore) LockCache() (func(), error) {
+	if err := checkWritable(); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.prepareDir(); err != nil {
+		return nil, err
+	}
+
+	return lockCachePath(s.path() + ".lock")
+}
+
+// lockCachePath takes an exclusive advisory lock on the lock file at lockPath
+// in a prepared cache directory, creating the file if needed.
+func lockCachePath(lockPath string) (func(), error) {
+	if err := checkCacheFile(lockPath); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(lockPath, os.O_RDONLY|os.O_CREATE|oNoFollow, 0600)
+	if err != nil {
+		return nil, err
+	}
+	chownToCacheOwner(lockPath)
+
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// Clear removes the cache file.
+func (s *FileCacheStore) Clear() error {
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// MemoryCacheStore keeps the cache in process memory. It is useful in tests
+// and for processes that must not persist anything.
+type MemoryCacheStore struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// NewMemoryCacheStore returns an empty in-memory store.
+func NewMemoryCacheStore() *MemoryCacheStore {
+	return &MemoryCacheStore{}
+}
+
+// Load returns a copy of the stored data.
+func (s *MemoryCacheStore) Load() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data == nil {
+		return nil, fs.ErrNotExist
+	}
+	return append([]byte(nil), s.data...), nil
+}
+
+// Save stores a copy of data.
+func (s *MemoryCacheStore) Save(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = append([]byte{}, data...)
+	return nil
+}
+
+// Clear discards the stored data.
+func (s *MemoryCacheStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.data)
+	s.data = nil
+	return nil
+}
+
+// FuncCacheStore adapts caller-supplied functions to the CacheStore interface,
+// e.g. to keep the cache in an application's existing config store.
+type FuncCacheStore struct {
+	LoadFunc  func() ([]byte, error) // Must return an error wrapping fs.ErrNotExist if empty
+	SaveFunc  func(data []byte) error
+	ClearFunc func() error
+}
+
+// Load calls LoadFunc.
+func (s *FuncCacheStore) Load() ([]byte, error) {
+	if s.LoadFunc == nil {
+		return nil, fs.ErrNotExist
+	}
+	return s.LoadFunc()
+}
+
+// Save calls SaveFunc.
+func (s *FuncCacheStore) Save(data []byte) error {
+	if s.SaveFunc == nil {
+		return fmt.Errorf("machid: FuncCacheStore has no SaveFunc")
+	}
+	return s.SaveFunc(data)
+}
+
+// Clear calls ClearFunc.
+func (s *FuncCacheStore) Clear() error {
+	if s.ClearFunc == nil {
+		return nil
+	}
+	return s.ClearFunc()
+}
@@ -0,0 +1,224 @@
+package machid
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// useMemoryCacheStore installs a fresh in-memory cache store for the test,
+// with the counter journal and watermark kept out of the home directory.
+func useMemoryCacheStore(t *testing.T) *MemoryCacheStore {
+	t.Helper()
+	store := NewMemoryCacheStore()
+	SetCacheStore(store)
+	SetCacheNamespace("")
+	SetJournalDir(t.TempDir())
+	SetWatermarkStore(NewMemoryCacheStore())
+	t.Cleanup(func() {
+		SetCacheStore(nil)
+		SetCacheNamespace("")
+		SetJournalDir("")
+		SetWatermarkStore(nil)
+	})
+	return store
+}
+
+func TestMemoryCacheStore(t *testing.T) {
+	store := NewMemoryCacheStore()
+
+	if _, err := store.Load(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load() on empty store expected fs.ErrNotExist, got: %v", err)
+	}
+	if err := store.Save([]byte("data")); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+	data, err := store.Load()
+	if err != nil || string(data) != "data" {
+		t.Errorf("Load() = %q, %v; expected \"data\"", data, err)
+	}
+	if err := store.Clear(); err != nil {
+		t.Fatalf("Clear() failed: %v", err)
+	}
+	if _, err := store.Load(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load() after Clear() expected fs.ErrNotExist, got: %v", err)
+	}
+}
+
+func TestSetCacheStore_GetOrGenerate(t *testing.T) {
+	store := useMemoryCacheStore(t)
+
+	emachid, fromCache, err := GetOrGenerateEMachID("test-salt")
+	if err != nil || fromCache {
+		t.Fatalf("GetOrGenerateEMachID() = %q, %v, %v", emachid, fromCache, err)
+	}
+	if _, err := store.Load(); err != nil {
+		t.Errorf("GetOrGenerateEMachID() did not save through the configured store: %v", err)
+	}
+
+	rotated, err := RotateEMachID("test-salt")
+	if err != nil || rotated == emachid {
+		t.Errorf("RotateEMachID() = %q, %v; expected a new ID", rotated, err)
+	}
+	cached, err := LoadCachedIDs()
+	if err != nil || cached.EMachID != rotated {
+		t.Errorf("LoadCachedIDs() = %+v, %v; expected rotated eMachID", cached, err)
+	}
+}
+
+func TestFuncCacheStore(t *testing.T) {
+	var saved []byte
+	SetCacheStore(&FuncCacheStore{
+		LoadFunc: func() ([]byte, error) {
+			if saved == nil {
+				return nil, fs.ErrNotExist
+			}
+			return saved, nil
+		},
+		SaveFunc:  func(data []byte) error { saved = data; return nil },
+		ClearFunc: func() error { saved = nil; return nil },
+	})
+	defer SetCacheStore(nil)
+
+	if err := SaveCachedIDs(&CachedMachineIDs{ReMachID: "remach"}); err != nil {
+		t.Fatalf("SaveCachedIDs() failed: %v", err)
+	}
+	cache, err := LoadCachedIDs()
+	if err != nil || cache.ReMachID != "remach" {
+		t.Errorf("LoadCachedIDs() = %+v, %v", cache, err)
+	}
+	if err := ClearCache(); err != nil || saved != nil {
+		t.Errorf("ClearCache() did not call ClearFunc: %v", err)
+	}
+}
+
+func TestFileCacheStore_Path(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "cache.json")
+	SetCacheStore(NewFileCacheStore(path))
+	defer SetCacheStore(nil)
+
+	if err := SaveCachedIDs(&CachedMachineIDs{ReMachID: "remach"}); err != nil {
+		t.Fatalf("SaveCachedIDs() failed: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("FileCacheStore did not write %s: %v", path, err)
+	}
+}
+
+func TestUpdateCachedIDs(t *testing.T) {
+	store := useMemoryCacheStore(t)
+
+	// fn errors abort the transaction
+	errAbort := errors.New("abort")
+	err := UpdateCachedIDs(func(cache *CachedMachineIDs) error {
+		cache.ReMachID = "not saved"
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Errorf("UpdateCachedIDs() expected fn error, got: %v", err)
+	}
+	if _, err := store.Load(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("UpdateCachedIDs() saved despite fn error: %v", err)
+	}
+
+	err = UpdateCachedIDs(func(cache *CachedMachineIDs) error {
+		if !cache.isEmpty() {
+			t.Errorf("UpdateCachedIDs() expected empty cache, got: %+v", cache)
+		}
+		cache.ReMachID = "saved"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateCachedIDs() failed: %v", err)
+	}
+	cache, err := LoadCachedIDs()
+	if err != nil || cache.ReMachID != "saved" {
+		t.Errorf("LoadCachedIDs() = %+v, %v", cache, err)
+	}
+}
+
+func TestIncrementActionCount_Concurrent(t *testing.T) {
+	useMemoryCacheStore(t)
+	if err := SaveCachedIDs(&CachedMachineIDs{EMachID: "emach"}); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, increments = 8, 50
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range increments {
+				if _, err := IncrementActionCount(); err != nil {
+					t.Errorf("IncrementActionCount() failed: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	cache, err := LoadCachedIDs()
+	if err != nil || cache.ActionCount != workers*increments {
+		t.Errorf("ActionCount = %+v, %v; expected %d", cache, err, workers*increments)
+	}
+}
+
+// TestFileCacheStore_CrossProcess increments the action count from several
+// processes sharing one cache file; no update may be lost.
+func TestFileCacheStore_CrossProcess(t *testing.T) {
+	if path := os.Getenv("MACHID_TEST_CACHE_PATH"); path != "" {
+		// Child process
+		SetCacheStore(NewFileCacheStore(path))
+		SetJournalDir(filepath.Join(filepath.Dir(path), "journal"))
+		SetWatermarkStore(NewFileCacheStore(filepath.Join(filepath.Dir(path), "watermark.json")))
+		SetActionJournal(true)
+		for range 25 {
+			if _, err := IncrementActionCount(); err != nil {
+				t.Fatalf("IncrementActionCount() failed: %v", err)
+			}
+		}
+		return
+	}
+
+	path := filepath.Join(t.TempDir(), "cache.json")
+	SetCacheStore(NewFileCacheStore(path))
+	SetJournalDir(filepath.Join(filepath.Dir(path), "journal"))
+	SetWatermarkStore(NewFileCacheStore(filepath.Join(filepath.Dir(path), "watermark.json")))
+	defer func() {
+		SetCacheStore(nil)
+		SetJournalDir("")
+		SetWatermarkStore(nil)
+	}()
+	if err := SaveCachedIDs(&CachedMachineIDs{EMachID: "emach"}); err != nil {
+		t.Fatal(err)
+	}
+
+	const processes = 4
+	var cmds []*exec.Cmd
+	for range processes {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestFileCacheStore_CrossProcess$")
+		cmd.Env = append(os.Environ(), "MACHID_TEST_CACHE_PATH="+path)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("child process failed: %v", err)
+		}
+	}
+
+	cache, err := LoadCachedIDs()
+	if err != nil || cache.ActionCount != processes*25 {
+		t.Errorf("ActionCount = %+v, %v; expected %d", cache, err, processes*25)
+	}
+	if count, err := GetCounter(ActionCounter); err != nil || count != processes*25 {
+		t.Errorf("GetCounter(ActionCounter) = %d, %v; expected %d", count, err, processes*25)
+	}
+}
@@ -0,0 +1,99 @@
+package machid
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestCacheNamespaces_SaltsDoNotCollide(t *testing.T) {
+	useMemoryCacheStore(t)
+
+	first, _, err := GetOrGenerateEMachID("salt-app-one")
+	if err != nil {
+		t.Fatalf("GetOrGenerateEMachID() failed: %v", err)
+	}
+	second, _, err := GetOrGenerateEMachID("salt-app-two")
+	if err != nil {
+		t.Fatalf("GetOrGenerateEMachID() failed: %v", err)
+	}
+	if first == second {
+		t.Fatal("different salts share one eMachID")
+	}
+
+	// Both applications keep their own cached IDs
+	again, fromCache, err := GetOrGenerateEMachID("salt-app-one")
+	if err != nil || !fromCache || again != first {
+		t.Errorf("GetOrGenerateEMachID() for first salt = %q, %v, %v; expected cached %q", again, fromCache, err, first)
+	}
+	again, fromCache, err = GetOrGenerateEMachID("salt-app-two")
+	if err != nil || !fromCache || again != second {
+		t.Errorf("GetOrGenerateEMachID() for second salt = %q, %v, %v; expected cached %q", again, fromCache, err, second)
+	}
+
+	names, err := ListCacheNamespaces()
+	if err != nil || len(names) != 2 || !slices.Contains(names, DefaultCacheNamespace) {
+		t.Errorf("ListCacheNamespaces() = %v, %v", names, err)
+	}
+}
+
+func TestCacheNamespaces_FetchAndDelete(t *testing.T) {
+	useMemoryCacheStore(t)
+
+	SetCacheNamespace("billing")
+	if err := SaveCachedIDs(&CachedMachineIDs{EMachID: "billing-emach"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IncrementActionCount(); err != nil {
+		t.Fatal(err)
+	}
+	SetCacheNamespace("telemetry")
+	if err := SaveCachedIDs(&CachedMachineIDs{EMachID: "telemetry-emach"}); err != nil {
+		t.Fatal(err)
+	}
+	SetCacheNamespace("")
+
+	billing, err := LoadCacheNamespace("billing")
+	if err != nil || billing.EMachID != "billing-emach" || billing.ActionCount != 1 {
+		t.Errorf("LoadCacheNamespace(billing) = %+v, %v", billing, err)
+	}
+	if billing != nil && billing.UpdatedAt == 0 {
+		t.Error("LoadCacheNamespace(billing) has no UpdatedAt timestamp")
+	}
+
+	if err := DeleteCacheNamespace("billing"); err != nil {
+		t.Fatalf("DeleteCacheNamespace() failed: %v", err)
+	}
+	if _, err := LoadCacheNamespace("billing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("LoadCacheNamespace() after delete expected fs.ErrNotExist, got: %v", err)
+	}
+	names, err := ListCacheNamespaces()
+	if err != nil || !slices.Equal(names, []string{"telemetry"}) {
+		t.Errorf("ListCacheNamespaces() = %v, %v; expected [telemetry]", names, err)
+	}
+}
+
+func TestCacheNamespaces_LegacyCache(t *testing.T) {
+	store := useMemoryCacheStore(t)
+	useTempFallbackDir(t)
+	useTempLedger(t)
+	if err := store.Save([]byte(`{"remach_id":"legacy-remach","emach_id":"legacy-emach","action_count":7}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := LoadCacheNamespace(DefaultCacheNamespace)
+	if err != nil || cache.ReMachID != "legacy-remach" || cache.ActionCount != 7 {
+		t.Errorf("legacy cache not migrated to the default namespace: %+v, %v", cache, err)
+	}
+
+	// A legacy cache without a salt cannot be sealed, so its reMachID is not trusted
+	remachid, fromCache, err := GetOrGenerateReMachID("any-salt")
+	if fromCache || remachid == "legacy-remach" {
+		t.Errorf("GetOrGenerateReMachID() = %q, %v, %v; expected unsealed legacy reMachID to be rejected", remachid, fromCache, err)
+	}
+	if os.Geteuid() != 0 && !errors.Is(err, ErrCacheTampered) {
+		t.Errorf("GetOrGenerateReMachID() expected ErrCacheTampered, got: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package machid
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ================================================================================
+// Time-Ordered eMachID Formats
+// ================================================================================
+//
+// The default eMachID is a random-ordered SHA-256 hash, which fragments B-tree
+// indexes when used as a primary key. The UUIDv7 (RFC 9562) and ULID variants
+// start with the generation time in milliseconds, so IDs sort by creation time.
+// Their remaining bits are an HMAC of fresh crypto/rand entropy and the
+// per-process counter keyed with the salt, so they stay unpredictable.
+
+// ErrInvalidEMachID is returned when an eMachID is not in a timestamped format
+// (UUIDv7, ULID or verifiable eMachID)
+var ErrInvalidEMachID = errors.New("machid: eMachID is not in a timestamped format")
+
+// crockfordAlphabet is the Crockford base32 alphabet used by ULIDs
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// keyedRandom returns n bytes of salt-keyed random data.
+func keyedRandom(salt string, n int) ([]byte, error) {
+	if salt == "" {
+		return nil, ErrEmptySalt
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("machid: failed to read random data: %w", err)
+	}
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write(nonce)
+	mac.Write(binary.BigEndian.AppendUint64(nil, emachidCounter.Add(1)))
+	return mac.Sum(nil)[:n], nil
+}
+
+// putTimestamp writes the Unix time in milliseconds as 48-bit big-endian.
+func putTimestamp(b []byte, t time.Time) {
+	ms := uint64(t.UnixMilli())
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+}
+
+// timestampOf reads a 48-bit big-endian millisecond timestamp.
+func timestampOf(b []byte) time.Time {
+	var ms uint64
+	for _, c := range b[:6] {
+		ms = ms<<8 | uint64(c)
+	}
+	return time.UnixMilli(int64(ms))
+}
+
+// GenerateEMachIDUUIDv7 generates an eMachID formatted as an RFC 9562 UUIDv7,
+// e.g. "01890a5d-ac96-7a3b-9c1e-5f0e2d4b8a17". IDs sort by generation time.
+// Does NOT require root privileges.
+//
+// Parameters:
+//   - salt: A non-empty string keying the random component
+//
+// Returns:
+//   - The eMachID as a lowercase UUID string
+//   - An error if salt is empty or the system random source fails
+func GenerateEMachIDUUIDv7(salt string) (string, error) {
+	random, err := keyedRandom(salt, 10)
+	if err != nil {
+		return "", err
+	}
+
+	var u [16]byte
+	putTimestamp(u[:6], time.Now())
+	u[6] = 0x70 | random[0]&0x0f // Version 7
+	u[7] = random[1]
+	u[8] = 0x80 | random[2]&0x3f // RFC 9562 variant
+	copy(u[9:], random[3:])
+
+	h := hex.EncodeToString(u[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
+
+// GenerateEMachIDULID generates an eMachID formatted as a ULID,
+// e.g. "01H4M5TB4P7ADQ2T3V9WZ8KXJN". IDs sort by generation time.
+// Does NOT require root privileges.
+//
+// Parameters:
+//   - salt: A non-empty string keying the random component
+//
+// Returns:
+//   - The eMachID as a 26-character Crockford base32 string
+//   - An error if salt is empty or the system random source fails
+func GenerateEMachIDULID(salt string) (string, error) {
+	random, err := keyedRandom(salt, 10)
+	if err != nil {
+		return "", err
+	}
+
+	var u [16]byte
+	putTimestamp(u[:6], time.Now())
+	copy(u[6:], random)
+	return encodeULID(u), nil
+}
+
+// encodeULID encodes 128 bits as 26 Crockford base32 characters.
+func encodeULID(u [16]byte) string {
+	hi, lo := binary.BigEndian.Uint64(u[:8]), binary.BigEndian.Uint64(u[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockfordAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// decodeULID decodes a ULID string (case-insensitive).
+func decodeULID(s string) ([16]byte, bool) {
+	var u [16]byte
+	if len(s) != 26 || s[0] > '7' {
+		return u, false
+	}
+	var hi, lo uint64
+	for _, c := range strings.ToUpper(s) {
+		switch c {
+		case 'I', 'L':
+			c = '1'
+		case 'O':
+			c = '0'
+		}
+		v := strings.IndexRune(crockfordAlphabet, c)
+		if v < 0 {
+			return u, false
+		}
+		hi = hi<<5 | lo>>59
+		lo = lo<<5 | uint64(v)
+	}
+	binary.BigEndian.PutUint64(u[:8], hi)
+	binary.BigEndian.PutUint64(u[8:], lo)
+	return u, true
+}
+
+// decodeUUIDv7 decodes a UUIDv7 string.
+func decodeUUIDv7(s string) ([16]byte, bool) {
+	var u [16]byte
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return u, false
+	}
+	raw := s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:]
+	if _, err := hex.Decode(u[:], []byte(raw)); err != nil {
+		return u, false
+	}
+	if u[6]>>4 != 7 || u[8]>>6 != 2 {
+		return u, false
+	}
+	return u, true
+}
+
+// ParseEMachIDTime extracts the generation time from an eMachID created by
+// GenerateEMachIDUUIDv7, GenerateEMachIDULID or GenerateVerifiableEMachID
+// (millisecond precision). The MAC of a verifiable eMachID is not checked;
+// use EMachIDVerifier for that.
+//
+// Parameters:
+//   - id: A UUIDv7, ULID or verifiable eMachID
+//
+// Returns:
+//   - The generation time
+//   - ErrInvalidEMachID for any other input, including hash-format eMachIDs
+//     (which carry no timestamp)
+func ParseEMachIDTime(id string) (time.Time, error) {
+	if u, ok := decodeUUIDv7(strings.ToLower(id)); ok {
+		return timestampOf(u[:]), nil
+	}
+	if u, ok := decodeULID(id); ok {
+		return timestampOf(u[:]), nil
+	}
+	if _, _, _, generatedAt, ok := parseVerifiableEMachID(id); ok {
+		return generatedAt, nil
+	}
+	return time.Time{}, ErrInvalidEMachID
+}
@@ -0,0 +1,86 @@
+package machid
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestGenerateEMachIDUUIDv7(t *testing.T) {
+	before := time.Now().Truncate(time.Millisecond)
+	id, err := GenerateEMachIDUUIDv7("test-salt")
+	if err != nil {
+		t.Fatalf("GenerateEMachIDUUIDv7() failed: %v", err)
+	}
+	after := time.Now()
+
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Errorf("GenerateEMachIDUUIDv7() = %q; not a UUIDv7", id)
+	}
+	ts, err := ParseEMachIDTime(id)
+	if err != nil || ts.Before(before) || ts.After(after) {
+		t.Errorf("ParseEMachIDTime(%q) = %v, %v; expected between %v and %v", id, ts, err, before, after)
+	}
+}
+
+func TestGenerateEMachIDULID(t *testing.T) {
+	before := time.Now().Truncate(time.Millisecond)
+	id, err := GenerateEMachIDULID("test-salt")
+	if err != nil {
+		t.Fatalf("GenerateEMachIDULID() failed: %v", err)
+	}
+	after := time.Now()
+
+	if !regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`).MatchString(id) {
+		t.Errorf("GenerateEMachIDULID() = %q; not a ULID", id)
+	}
+	ts, err := ParseEMachIDTime(id)
+	if err != nil || ts.Before(before) || ts.After(after) {
+		t.Errorf("ParseEMachIDTime(%q) = %v, %v; expected between %v and %v", id, ts, err, before, after)
+	}
+}
+
+func TestEMachIDFormats_SortByTime(t *testing.T) {
+	for name, generate := range map[string]func(string) (string, error){
+		"UUIDv7": GenerateEMachIDUUIDv7,
+		"ULID":   GenerateEMachIDULID,
+	} {
+		var ids []string
+		for range 3 {
+			id, err := generate("test-salt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+			time.Sleep(2 * time.Millisecond)
+		}
+		if !slices.IsSorted(ids) {
+			t.Errorf("%s IDs do not sort by generation time: %v", name, ids)
+		}
+	}
+}
+
+func TestULID_RoundTrip(t *testing.T) {
+	u := [16]byte{0x01, 0x89, 0x0a, 0x5d, 0xac, 0x96, 0xff, 0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88}
+	decoded, ok := decodeULID(encodeULID(u))
+	if !ok || decoded != u {
+		t.Errorf("decodeULID(encodeULID()) = %x, %v; expected %x", decoded, ok, u)
+	}
+	if encodeULID([16]byte{}) != "00000000000000000000000000" {
+		t.Error("encodeULID() of zero is not all zeros")
+	}
+}
+
+func TestParseEMachIDTime_Invalid(t *testing.T) {
+	hashID, _ := GenerateEMachID("test-salt")
+	for _, id := range []string{"", hashID, "not-an-id", "01890a5d-ac96-4a3b-9c1e-5f0e2d4b8a17", "81H4M5TB4P7ADQ2T3V9WZ8KXJN"} {
+		if _, err := ParseEMachIDTime(id); !errors.Is(err, ErrInvalidEMachID) {
+			t.Errorf("ParseEMachIDTime(%q) expected ErrInvalidEMachID, got: %v", id, err)
+		}
+	}
+	if _, err := GenerateEMachIDULID(""); !errors.Is(err, ErrEmptySalt) {
+		t.Errorf("GenerateEMachIDULID() with empty salt expected ErrEmptySalt, got: %v", err)
+	}
+}
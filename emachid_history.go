@@ -0,0 +1,145 @@
+package machid
+
+import (
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// ================================================================================
+// eMachID History
+// ================================================================================
+//
+// Requests in flight during a rotation still carry the previous eMachID. The
+// cache therefore keeps a bounded history of retired eMachIDs, and a
+// RotationRecord lets servers accept the previous ID for a grace window.
+
+// DefaultEMachIDHistoryLimit is the default number of retired eMachIDs kept per namespace
+const DefaultEMachIDHistoryLimit = 5
+
+// RetiredEMachID is a previous eMachID kept in the cache history.
+type RetiredEMachID struct {
+	ID        string `json:"id"`
+	RetiredAt int64  `json:"retired_at"` // Unix time of the rotation
+	Reason    string `json:"reason,omitempty"`
+}
+
+// RotationRecord describes the most recent rotation. Clients can pass it to
+// servers, which use Accepts to honor the previous eMachID for a grace window.
+type RotationRecord struct {
+	PreviousID string    `json:"previous_id"`
+	CurrentID  string    `json:"current_id"`
+	RotatedAt  time.Time `json:"rotated_at"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+var (
+	emachidHistoryLimit   = DefaultEMachIDHistoryLimit
+	emachidHistoryLimitMu sync.RWMutex
+)
+
+// SetEMachIDHistoryLimit sets how many retired eMachIDs are kept per cache
+// namespace. Zero disables the history.
+//
+// Parameters:
+//   - limit: Maximum number of retired eMachIDs (DefaultEMachIDHistoryLimit by default)
+func SetEMachIDHistoryLimit(limit int) {
+	emachidHistoryLimitMu.Lock()
+	defer emachidHistoryLimitMu.Unlock()
+	emachidHistoryLimit = max(limit, 0)
+}
+
+// GetEMachIDHistoryLimit returns the number of retired eMachIDs kept per namespace.
+func GetEMachIDHistoryLimit() int {
+	emachidHistoryLimitMu.RLock()
+	defer emachidHistoryLimitMu.RUnlock()
+	return emachidHistoryLimit
+}
+
+// retireEMachID appends the current eMachID to the history, dropping the
+// oldest entries beyond the limit.
+func retireEMachID(cache *CachedMachineIDs, reason string, t time.Time) {
+	if cache.EMachID == "" {
+		return
+	}
+	history := append(cache.EMachIDHistory, RetiredEMachID{ID: cache.EMachID, RetiredAt: t.Unix(), Reason: reason})
+	if limit := GetEMachIDHistoryLimit(); len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	if len(history) == 0 {
+		history = nil
+	}
+	cache.EMachIDHistory = history
+}
+
+// Record returns the rotation record for the event.
+func (e RotationEvent) Record() RotationRecord {
+	return RotationRecord{PreviousID: e.OldID, CurrentID: e.NewID, RotatedAt: e.Time, Reason: e.Reason}
+}
+
+// Accepts reports whether a server should accept id at time at: the current
+// eMachID is always accepted, the previous one until grace after the rotation.
+//
+// Parameters:
+//   - id: The eMachID presented by the client
+//   - grace: How long the previous eMachID stays valid after the rotation
+//   - at: The time of the check, usually time.Now()
+func (r *RotationRecord) Accepts(id string, grace time.Duration, at time.Time) bool {
+	if id == "" {
+		return false
+	}
+	if id == r.CurrentID {
+		return true
+	}
+	return id == r.PreviousID && !at.After(r.RotatedAt.Add(grace))
+}
+
+// LastRotation returns the most recent rotation in the current cache namespace.
+// Returns an error wrapping fs.ErrNotExist if the eMachID was never rotated
+// (or the history is disabled).
+func LastRotation() (*RotationRecord, error) {
+	cache, err := LoadCachedIDs()
+	if err != nil {
+		return nil, err
+	}
+	if len(cache.EMachIDHistory) == 0 {
+		return nil, fmt.Errorf("machid: no eMachID rotation recorded: %w", fs.ErrNotExist)
+	}
+	last := cache.EMachIDHistory[len(cache.EMachIDHistory)-1]
+	return &RotationRecord{
+		PreviousID: last.ID,
+		CurrentID:  cache.EMachID,
+		RotatedAt:  time.Unix(last.RetiredAt, 0),
+		Reason:     last.Reason,
+	}, nil
+}
+
+// IsRecentEMachID reports whether id is the current eMachID of any cache
+// namespace, or was retired from one within window.
+//
+// Parameters:
+//   - id: The eMachID to check
+//   - window: How long retired eMachIDs count as recent
+func IsRecentEMachID(id string, window time.Duration) (bool, error) {
+	if id == "" {
+		return false, nil
+	}
+	doc, err := loadCacheDocument()
+	if err != nil {
+		return false, err
+	}
+
+	t := now()
+	for _, cache := range doc.Namespaces {
+		if cache.EMachID == id {
+			return true, nil
+		}
+		for _, retired := range cache.EMachIDHistory {
+			if retired.ID == id && !t.After(time.Unix(retired.RetiredAt, 0).Add(window)) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
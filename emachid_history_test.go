@@ -0,0 +1,92 @@
+package machid
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+func TestEMachIDHistory_Bounded(t *testing.T) {
+	useMemoryCacheStore(t)
+	SetEMachIDHistoryLimit(2)
+	defer SetEMachIDHistoryLimit(DefaultEMachIDHistoryLimit)
+
+	ids := make([]string, 4)
+	ids[0], _, _ = GetOrGenerateEMachID("test-salt")
+	for i := 1; i < len(ids); i++ {
+		var err error
+		if ids[i], err = RotateEMachID("test-salt"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache, err := LoadCachedIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.EMachIDHistory) != 2 || cache.EMachIDHistory[0].ID != ids[1] || cache.EMachIDHistory[1].ID != ids[2] {
+		t.Errorf("unexpected history: %+v", cache.EMachIDHistory)
+	}
+	if cache.EMachIDHistory[1].Reason != RotationReasonManual || cache.EMachIDHistory[1].RetiredAt == 0 {
+		t.Errorf("history entry lacks rotation details: %+v", cache.EMachIDHistory[1])
+	}
+}
+
+func TestIsRecentEMachID(t *testing.T) {
+	useMemoryCacheStore(t)
+	clock := useFakeClock(t, time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+
+	old, _, _ := GetOrGenerateEMachID("salt-one")
+	current, _ := RotateEMachID("salt-one")
+	other, _, _ := GetOrGenerateEMachID("salt-two")
+
+	for _, id := range []string{current, other, old} {
+		if recent, err := IsRecentEMachID(id, time.Minute); err != nil || !recent {
+			t.Errorf("IsRecentEMachID(%q) = %v, %v; expected true", id, recent, err)
+		}
+	}
+
+	clock.t = clock.t.Add(2 * time.Minute)
+	if recent, _ := IsRecentEMachID(old, time.Minute); recent {
+		t.Error("IsRecentEMachID() accepted an eMachID retired outside the window")
+	}
+	if recent, _ := IsRecentEMachID(current, time.Minute); !recent {
+		t.Error("IsRecentEMachID() rejected the current eMachID")
+	}
+	if recent, _ := IsRecentEMachID("unknown", time.Hour); recent {
+		t.Error("IsRecentEMachID() accepted an unknown eMachID")
+	}
+}
+
+func TestRotationRecord(t *testing.T) {
+	useMemoryCacheStore(t)
+	rotatedAt := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, rotatedAt)
+
+	if _, err := LastRotation(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("LastRotation() without cache expected fs.ErrNotExist, got: %v", err)
+	}
+
+	previous, _, _ := GetOrGenerateEMachID("test-salt")
+	if _, err := LastRotation(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("LastRotation() before any rotation expected fs.ErrNotExist, got: %v", err)
+	}
+	current, _ := RotateEMachID("test-salt")
+
+	record, err := LastRotation()
+	if err != nil || record.PreviousID != previous || record.CurrentID != current || !record.RotatedAt.Equal(rotatedAt) {
+		t.Fatalf("LastRotation() = %+v, %v", record, err)
+	}
+
+	grace := 30 * time.Second
+	if !record.Accepts(previous, grace, rotatedAt.Add(grace)) {
+		t.Error("Accepts() rejected the previous eMachID within the grace window")
+	}
+	if record.Accepts(previous, grace, rotatedAt.Add(grace+time.Second)) {
+		t.Error("Accepts() accepted the previous eMachID after the grace window")
+	}
+	if !record.Accepts(current, 0, rotatedAt.Add(time.Hour)) || record.Accepts("other", grace, rotatedAt) {
+		t.Error("Accepts() mishandled the current or an unknown eMachID")
+	}
+}
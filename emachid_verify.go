@@ -0,0 +1,175 @@
+package machid
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ================================================================================
+// Verifiable eMachIDs
+// ================================================================================
+//
+// A verifiable eMachID carries its generation time and a MAC keyed with a
+// verification key derived from the host's reMachID:
+//
+//	v1.<timestamp ms, 16 hex>.<nonce, 32 hex>.<mac, 32 hex>
+//
+// A backend that stored the verification key when the host was enrolled can
+// confirm the ID's origin and freshness; the key cannot be turned back into
+// the reMachID, so the host never reveals it.
+
+// Verifiable eMachID errors
+var (
+	// ErrEMachIDForged is returned when a verifiable eMachID's MAC does not match
+	ErrEMachIDForged = errors.New("machid: eMachID was not generated by this host")
+
+	// ErrEMachIDStale is returned when a verifiable eMachID is older than allowed
+	// or dated in the future
+	ErrEMachIDStale = errors.New("machid: eMachID is not fresh")
+)
+
+// verifiableEMachIDVersion prefixes verifiable eMachIDs
+const verifiableEMachIDVersion = "v1"
+
+// EMachIDVerificationKey derives the key used to create and verify verifiable
+// eMachIDs from a reMachID. Share this key (not the reMachID) with the backend
+// that verifies eMachIDs.
+//
+// Parameters:
+//   - remachid: The host's reMachID
+//
+// Returns:
+//   - A 32-byte verification key
+func EMachIDVerificationKey(remachid string) []byte {
+	mac := hmac.New(sha256.New, []byte(remachid))
+	mac.Write([]byte("machid emachid verification key v1"))
+	return mac.Sum(nil)
+}
+
+// verifiableEMachIDMAC computes the MAC over the timestamp and nonce fields.
+func verifiableEMachIDMAC(key []byte, timestamp, nonce string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(verifiableEMachIDVersion + "." + timestamp + "." + nonce))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// newVerifiableEMachID creates a verifiable eMachID dated now.
+func newVerifiableEMachID(key []byte, now time.Time) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("machid: failed to read random data: %w", err)
+	}
+	// Keep IDs generated within one millisecond distinct even if the random
+	// source were to repeat
+	binary.BigEndian.PutUint32(nonce[12:], uint32(emachidCounter.Add(1)))
+
+	timestamp := hex.EncodeToString(binary.BigEndian.AppendUint64(nil, uint64(now.UnixMilli())))
+	nonceHex := hex.EncodeToString(nonce)
+	return verifiableEMachIDVersion + "." + timestamp + "." + nonceHex + "." + verifiableEMachIDMAC(key, timestamp, nonceHex), nil
+}
+
+// GenerateVerifiableEMachID generates an eMachID whose origin and freshness can
+// be verified with EMachIDVerifier. The reMachID is obtained through
+// GetOrGenerateReMachID, so root is only needed if it is not cached.
+//
+// Parameters:
+//   - salt: Salt of the reMachID the verification key is derived from
+//
+// Returns:
+//   - The eMachID ("v1.<timestamp>.<nonce>.<mac>")
+//   - An error if the reMachID cannot be obtained
+func GenerateVerifiableEMachID(salt string) (string, error) {
+	if salt == "" {
+		return "", ErrEmptySalt
+	}
+	remachid, _, err := GetOrGenerateReMachID(salt)
+	if err != nil {
+		return "", err
+	}
+	key := EMachIDVerificationKey(remachid)
+	clearString(&remachid)
+	return newVerifiableEMachID(key, time.Now())
+}
+
+// parseVerifiableEMachID splits a verifiable eMachID into its fields.
+func parseVerifiableEMachID(id string) (timestamp, nonce, mac string, generatedAt time.Time, ok bool) {
+	parts := strings.Split(id, ".")
+	if len(parts) != 4 || parts[0] != verifiableEMachIDVersion || len(parts[1]) != 16 || len(parts[2]) != 32 || len(parts[3]) != 32 {
+		return "", "", "", time.Time{}, false
+	}
+	ts, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return "", "", "", time.Time{}, false
+	}
+	for _, field := range parts[2:] {
+		if _, err := hex.DecodeString(field); err != nil {
+			return "", "", "", time.Time{}, false
+		}
+	}
+	return parts[1], parts[2], parts[3], time.UnixMilli(int64(binary.BigEndian.Uint64(ts))), true
+}
+
+// EMachIDVerifier verifies eMachIDs created by GenerateVerifiableEMachID.
+type EMachIDVerifier struct {
+	// Key is the host's verification key (see EMachIDVerificationKey)
+	Key []byte
+
+	// MaxAge rejects eMachIDs older than this. Zero disables the check.
+	MaxAge time.Duration
+
+	// MaxClockSkew is how far in the future an eMachID may be dated.
+	// Defaults to one minute.
+	MaxClockSkew time.Duration
+}
+
+// NewEMachIDVerifier returns a verifier for the host with the given reMachID.
+//
+// Parameters:
+//   - remachid: The host's reMachID
+//   - maxAge: Maximum accepted eMachID age (0 for no limit)
+func NewEMachIDVerifier(remachid string, maxAge time.Duration) *EMachIDVerifier {
+	return &EMachIDVerifier{Key: EMachIDVerificationKey(remachid), MaxAge: maxAge}
+}
+
+// Verify checks that id was generated by the host and is fresh.
+//
+// Parameters:
+//   - id: A verifiable eMachID
+//
+// Returns:
+//   - The generation time of the eMachID
+//   - ErrInvalidEMachID if id is not a verifiable eMachID, ErrEMachIDForged if
+//     the MAC does not match, or ErrEMachIDStale if it is too old or in the future
+func (v *EMachIDVerifier) Verify(id string) (time.Time, error) {
+	return v.verifyAt(id, time.Now())
+}
+
+// verifyAt verifies id relative to now.
+func (v *EMachIDVerifier) verifyAt(id string, now time.Time) (time.Time, error) {
+	timestamp, nonce, mac, generatedAt, ok := parseVerifiableEMachID(id)
+	if !ok {
+		return time.Time{}, ErrInvalidEMachID
+	}
+	if !hmac.Equal([]byte(mac), []byte(verifiableEMachIDMAC(v.Key, timestamp, nonce))) {
+		return time.Time{}, ErrEMachIDForged
+	}
+
+	skew := v.MaxClockSkew
+	if skew == 0 {
+		skew = time.Minute
+	}
+	if generatedAt.After(now.Add(skew)) {
+		return generatedAt, fmt.Errorf("%w: dated %s in the future", ErrEMachIDStale, generatedAt.Sub(now).Round(time.Millisecond))
+	}
+	if v.MaxAge > 0 && now.Sub(generatedAt) > v.MaxAge {
+		return generatedAt, fmt.Errorf("%w: generated %s ago", ErrEMachIDStale, now.Sub(generatedAt).Round(time.Millisecond))
+	}
+	return generatedAt, nil
+}
@@ -0,0 +1,65 @@
+package machid
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEMachIDVerifier(t *testing.T) {
+	now := time.Now()
+	key := EMachIDVerificationKey("host-remachid")
+	id, err := newVerifiableEMachID(key, now)
+	if err != nil {
+		t.Fatalf("newVerifiableEMachID() failed: %v", err)
+	}
+	if strings.Contains(id, "host-remachid") {
+		t.Fatal("verifiable eMachID reveals the reMachID")
+	}
+
+	verifier := NewEMachIDVerifier("host-remachid", time.Hour)
+	generatedAt, err := verifier.verifyAt(id, now.Add(time.Minute))
+	if err != nil || generatedAt.UnixMilli() != now.UnixMilli() {
+		t.Errorf("Verify() = %v, %v; expected %v", generatedAt, err, now)
+	}
+	if ts, err := ParseEMachIDTime(id); err != nil || !ts.Equal(generatedAt) {
+		t.Errorf("ParseEMachIDTime() = %v, %v; expected %v", ts, err, generatedAt)
+	}
+
+	// Other hosts, stale and future-dated IDs are rejected
+	if _, err := NewEMachIDVerifier("other-host", 0).verifyAt(id, now); !errors.Is(err, ErrEMachIDForged) {
+		t.Errorf("Verify() with another host's key expected ErrEMachIDForged, got: %v", err)
+	}
+	if _, err := verifier.verifyAt(id, now.Add(2*time.Hour)); !errors.Is(err, ErrEMachIDStale) {
+		t.Errorf("Verify() of an old eMachID expected ErrEMachIDStale, got: %v", err)
+	}
+	if _, err := verifier.verifyAt(id, now.Add(-time.Hour)); !errors.Is(err, ErrEMachIDStale) {
+		t.Errorf("Verify() of a future eMachID expected ErrEMachIDStale, got: %v", err)
+	}
+
+	// Any modification breaks the MAC
+	parts := strings.Split(id, ".")
+	parts[1] = "0000000000000000"
+	if _, err := verifier.verifyAt(strings.Join(parts, "."), now); !errors.Is(err, ErrEMachIDForged) {
+		t.Errorf("Verify() of a re-dated eMachID expected ErrEMachIDForged, got: %v", err)
+	}
+	if _, err := verifier.Verify("not-an-emachid"); !errors.Is(err, ErrInvalidEMachID) {
+		t.Errorf("Verify() of garbage expected ErrInvalidEMachID, got: %v", err)
+	}
+}
+
+func TestGenerateVerifiableEMachID_FromCache(t *testing.T) {
+	useMemoryCacheStore(t)
+	if err := SaveCachedIDs(&CachedMachineIDs{ReMachID: "cached-remachid", Salt: "test-salt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := GenerateVerifiableEMachID("test-salt")
+	if err != nil {
+		t.Fatalf("GenerateVerifiableEMachID() failed: %v", err)
+	}
+	if _, err := NewEMachIDVerifier("cached-remachid", time.Minute).Verify(id); err != nil {
+		t.Errorf("Verify() rejected a freshly generated eMachID: %v", err)
+	}
+}
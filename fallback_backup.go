@@ -0,0 +1,390 @@
+package machid
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ================================================================================
+// Fallback Identity Export/Import
+// ================================================================================
+//
+// A fallback-based machine identity lives only in /etc/.machid. ExportFallback and
+// ImportFallback move it to rebuilt hardware as a passphrase-encrypted bundle so
+// the reMachID survives the move. Every import is recorded in an audit log.
+
+// Bundle errors
+var (
+	// ErrNoFallbackFiles is returned when exporting without fallback files
+	ErrNoFallbackFiles = errors.New("machid: no filesystem fallback identity to export")
+
+	// ErrFallbackExists is returned when importing over an existing fallback identity without force
+	ErrFallbackExists = errors.New("machid: a filesystem fallback identity already exists (use force to overwrite)")
+
+	// ErrEmptyPassphrase is returned when an empty passphrase is provided
+	ErrEmptyPassphrase = errors.New("machid: passphrase cannot be empty")
+
+	// ErrBundleFormat is returned when a bundle is malformed or has an unsupported version
+	ErrBundleFormat = errors.New("machid: invalid or unsupported fallback bundle")
+
+	// ErrBundleChecksum is returned when a bundle fails its checksum (corrupted in transit)
+	ErrBundleChecksum = errors.New("machid: fallback bundle checksum mismatch")
+
+	// ErrBundleDecrypt is returned when a bundle cannot be decrypted (wrong passphrase or tampering)
+	ErrBundleDecrypt = errors.New("machid: failed to decrypt fallback bundle (wrong passphrase?)")
+)
+
+const (
+	// fallbackBundleFormat identifies machid fallback bundles
+	fallbackBundleFormat = "machid-fallback"
+
+	// FallbackBundleVersion is the bundle format version written by ExportFallback
+	FallbackBundleVersion = 1
+
+	// maxBundleIterations bounds the KDF work an imported bundle can request
+	maxBundleIterations = 10_000_000
+
+	// bundleSaltLength is the length of the random KDF salt in a bundle
+	bundleSaltLength = 16
+)
+
+var (
+	// bundleIterations is the PBKDF2-SHA256 iteration count for new bundles
+	bundleIterations = 600_000
+
+	// Import audit log file name inside the fallback directory
+	importLogFile = ".mimports"
+)
+
+// fallbackBundle is the on-the-wire bundle format.
+type fallbackBundle struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	KDFSalt    []byte `json:"kdf_salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+	// Checksum is the hex SHA-256 of the ciphertext, so corruption can be
+	// reported separately from a wrong passphrase.
+	Checksum string `json:"checksum"`
+}
+
+// fallbackPayload is the encrypted content of a bundle.
+type fallbackPayload struct {
+	Serial     string    `json:"serial"`
+	UUID       string    `json:"uuid"`
+	Hostname   string    `json:"hostname"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+// ImportRecord is an entry in the fallback import audit log.
+type ImportRecord struct {
+	ImportedAt     time.Time `json:"imported_at"`
+	SourceHostname string    `json:"source_hostname"` // Host the bundle was exported from
+	ExportedAt     time.Time `json:"exported_at"`     // When the bundle was exported
+	Checksum       string    `json:"checksum"`        // Bundle checksum
+	Forced         bool      `json:"forced"`          // True if an existing identity was overwritten
+}
+
+// bundleKey derives the AES-256 key for a bundle from the passphrase.
+func bundleKey(passphrase string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+}
+
+// ExportFallback exports the filesystem fallback identity as an encrypted bundle.
+// The bundle is encrypted with AES-256-GCM using a key derived from the passphrase
+// (PBKDF2-SHA256) and carries a format version and a checksum.
+//
+// Parameters:
+//   - passphrase: A non-empty passphrase required to import the bundle
+//
+// Returns:
+//   - The bundle bytes (JSON)
+//   - An error if root privileges are missing or no fallback identity exists
+func ExportFallback(passphrase string) ([]byte, error) {
+	if err := checkRoot(); err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, ErrEmptyPassphrase
+	}
+
+	serial, uuid, ok := readFallbackFiles()
+	if !ok {
+		return nil, ErrNoFallbackFiles
+	}
+
+	hostname, _ := os.Hostname()
+	payload, err := json.Marshal(fallbackPayload{
+		Serial:     serial,
+		UUID:       uuid,
+		Hostname:   hostname,
+		ExportedAt: time.Now().UTC(),
+	})
+	clearString(&serial)
+	clearString(&uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(payload)
+
+	bundle := fallbackBundle{
+		Format:     fallbackBundleFormat,
+		Version:    FallbackBundleVersion,
+		KDF:        "pbkdf2-sha256",
+		Iterations: bundleIterations,
+		KDFSalt:    make([]byte, bundleSaltLength),
+	}
+	if _, err := io.ReadFull(rand.Reader, bundle.KDFSalt); err != nil {
+		return nil, err
+	}
+
+	key, err := bundleKey(passphrase, bundle.KDFSalt, bundle.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	bundle.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, bundle.Nonce); err != nil {
+		return nil, err
+	}
+
+	// Bind the header to the ciphertext so it cannot be swapped
+	bundle.Ciphertext = gcm.Seal(nil, bundle.Nonce, payload, bundleAAD(&bundle))
+	sum := sha256.Sum256(bundle.Ciphertext)
+	bundle.Checksum = hex.EncodeToString(sum[:])
+
+	return json.MarshalIndent(bundle, "", "  ")
+}
+
+// bundleAAD returns the additional authenticated data for a bundle.
+func bundleAAD(b *fallbackBundle) []byte {
+	return fmt.Appendf(nil, "%s/%d/%s/%d", b.Format, b.Version, b.KDF, b.Iterations)
+}
+
+// ImportFallback installs a fallback identity from a bundle created by
+// ExportFallback. The import is recorded in the audit log (see ReadImportLog)
+// and reported through the logger.
+//
+// Parameters:
+//   - bundle: The bundle bytes
+//   - passphrase: The passphrase used at export time
+//   - force: Overwrite an existing fallback identity on this host
+//
+// Returns an error if root privileges are missing, the bundle is corrupt or
+// cannot be decrypted, or a fallback identity exists and force is false.
+func ImportFallback(bundle []byte, passphrase string, force bool) error {
+	if err := checkRoot(); err != nil {
+		return err
+	}
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	if passphrase == "" {
+		return ErrEmptyPassphrase
+	}
+
+	var b fallbackBundle
+	if err := json.Unmarshal(bundle, &b); err != nil {
+		return fmt.Errorf("%w: %v", ErrBundleFormat, err)
+	}
+	if b.Format != fallbackBundleFormat || b.Version != FallbackBundleVersion || b.KDF != "pbkdf2-sha256" {
+		return fmt.Errorf("%w: format %q version %d", ErrBundleFormat, b.Format, b.Version)
+	}
+	if b.Iterations <= 0 || b.Iterations > maxBundleIterations {
+		return fmt.Errorf("%w: iteration count %d out of range", ErrBundleFormat, b.Iterations)
+	}
+	if len(b.KDFSalt) != bundleSaltLength {
+		return fmt.Errorf("%w: KDF salt length %d, expected %d", ErrBundleFormat, len(b.KDFSalt), bundleSaltLength)
+	}
+
+	sum := sha256.Sum256(b.Ciphertext)
+	if hex.EncodeToString(sum[:]) != b.Checksum {
+		return ErrBundleChecksum
+	}
+
+	key, err := bundleKey(passphrase, b.KDFSalt, b.Iterations)
+	if err != nil {
+		return err
+	}
+	defer clear(key)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	if len(b.Nonce) != gcm.NonceSize() {
+		return fmt.Errorf("%w: bad nonce length", ErrBundleFormat)
+	}
+	plaintext, err := gcm.Open(nil, b.Nonce, b.Ciphertext, bundleAAD(&b))
+	if err != nil {
+		return ErrBundleDecrypt
+	}
+	defer clear(plaintext)
+
+	var payload fallbackPayload
+	if err := json.Unmarshal(plaintext, &payload); err != nil || payload.Serial == "" || payload.UUID == "" {
+		return fmt.Errorf("%w: invalid payload", ErrBundleFormat)
+	}
+	defer clearString(&payload.Serial)
+	defer clearString(&payload.UUID)
+
+	existed := HasFallbackFiles()
+	if existed && !force {
+		return ErrFallbackExists
+	}
+
+	if err := installFallbackFiles(payload.Serial, payload.UUID); err != nil {
+		return fmt.Errorf("%w: %v", ErrFallbackFileCreation, err)
+	}
+
+	record := ImportRecord{
+		ImportedAt:     time.Now().UTC(),
+		SourceHostname: payload.Hostname,
+		ExportedAt:     payload.ExportedAt,
+		Checksum:       b.Checksum,
+		Forced:         existed,
+	}
+	logWarning(fmt.Sprintf("WARNING: machid - Imported fallback identity exported from %q at %s (overwrote existing: %v)",
+		record.SourceHostname, record.ExportedAt.Format(time.RFC3339), record.Forced))
+	if err := appendImportRecord(record); err != nil {
+		return fmt.Errorf("fallback identity imported but audit log could not be written: %w", err)
+	}
+
+	return nil
+}
+
+// installFallbackFiles replaces the fallback files as a pair. Both files are
+// written and synced to temporary files before either is renamed into place,
+// and the serial file is restored if the UUID file cannot be renamed, so a
+// failed import never leaves a mix of old and new identifiers.
+func installFallbackFiles(serial, uuid string) error {
+	if err := os.MkdirAll(fallbackDir, 0700); err != nil {
+		return err
+	}
+
+	serialPath := filepath.Join(fallbackDir, fallbackSerialFile)
+	uuidPath := filepath.Join(fallbackDir, fallbackUUIDFile)
+
+	serialTmp, err := stageFile(serialPath, []byte(serial))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(serialTmp) // No-op after a successful rename
+	uuidTmp, err := stageFile(uuidPath, []byte(uuid))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(uuidTmp)
+
+	oldSerial, readErr := os.ReadFile(serialPath)
+	if readErr != nil && !os.IsNotExist(readErr) {
+		return readErr
+	}
+	defer clear(oldSerial)
+
+	if err := os.Rename(serialTmp, serialPath); err != nil {
+		return err
+	}
+	if err := os.Rename(uuidTmp, uuidPath); err != nil {
+		// Roll back to the previous serial so the identifiers stay paired
+		if readErr == nil {
+			if rollbackErr := writeFileAtomic(serialPath, oldSerial, 0600); rollbackErr != nil {
+				return fmt.Errorf("%v (rollback failed: %v)", err, rollbackErr)
+			}
+		} else {
+			os.Remove(serialPath)
+		}
+		return err
+	}
+	return nil
+}
+
+// stageFile writes data to a synced temporary file next to path and returns
+// the temporary file's name.
+func stageFile(path string, data []byte) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	if err := tmp.Chmod(0600); err == nil {
+		if _, err = tmp.Write(data); err == nil {
+			err = tmp.Sync()
+		}
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// appendImportRecord appends a record to the import audit log.
+func appendImportRecord(record ImportRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(fallbackDir, importLogFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadImportLog returns all recorded fallback identity imports, oldest first.
+// Requires root privileges to read the default location.
+func ReadImportLog() ([]ImportRecord, error) {
+	f, err := os.Open(filepath.Join(fallbackDir, importLogFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []ImportRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record ImportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,144 @@
+package machid
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportImportFallback_AsRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	silenceLogger(t)
+
+	oldIterations := bundleIterations
+	bundleIterations = 1000
+	defer func() { bundleIterations = oldIterations }()
+
+	dir := useTempFallbackDir(t)
+	writeFallbackFiles(t, dir, "exported-serial", "exported-uuid")
+
+	bundle, err := ExportFallback("correct horse")
+	if err != nil {
+		t.Fatalf("ExportFallback() failed: %v", err)
+	}
+
+	// Import onto a "rebuilt" host without fallback files
+	if err := ClearFallbackFiles(); err != nil {
+		t.Fatalf("ClearFallbackFiles() failed: %v", err)
+	}
+
+	if err := ImportFallback(bundle, "wrong passphrase", false); !errors.Is(err, ErrBundleDecrypt) {
+		t.Errorf("ImportFallback() with wrong passphrase expected ErrBundleDecrypt, got: %v", err)
+	}
+
+	if err := ImportFallback(bundle, "correct horse", false); err != nil {
+		t.Fatalf("ImportFallback() failed: %v", err)
+	}
+	serial, uuid, ok := readFallbackFiles()
+	if !ok || serial != "exported-serial" || uuid != "exported-uuid" {
+		t.Errorf("ImportFallback() restored wrong identity: %q %q %v", serial, uuid, ok)
+	}
+
+	// Refuse to overwrite without force
+	if err := ImportFallback(bundle, "correct horse", false); !errors.Is(err, ErrFallbackExists) {
+		t.Errorf("ImportFallback() over existing identity expected ErrFallbackExists, got: %v", err)
+	}
+	if err := ImportFallback(bundle, "correct horse", true); err != nil {
+		t.Errorf("ImportFallback() with force failed: %v", err)
+	}
+
+	records, err := ReadImportLog()
+	if err != nil {
+		t.Fatalf("ReadImportLog() failed: %v", err)
+	}
+	if len(records) != 2 || records[0].Forced || !records[1].Forced {
+		t.Errorf("ReadImportLog() returned unexpected records: %+v", records)
+	}
+}
+
+func TestImportFallback_Checksum(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+
+	oldIterations := bundleIterations
+	bundleIterations = 1000
+	defer func() { bundleIterations = oldIterations }()
+
+	dir := useTempFallbackDir(t)
+	writeFallbackFiles(t, dir, "serial", "uuid")
+
+	bundle, err := ExportFallback("passphrase")
+	if err != nil {
+		t.Fatalf("ExportFallback() failed: %v", err)
+	}
+
+	var b fallbackBundle
+	if err := json.Unmarshal(bundle, &b); err != nil {
+		t.Fatal(err)
+	}
+	b.Ciphertext[0] ^= 0xff
+	corrupted, _ := json.Marshal(b)
+
+	if err := ImportFallback(corrupted, "passphrase", true); !errors.Is(err, ErrBundleChecksum) {
+		t.Errorf("ImportFallback() with corrupted bundle expected ErrBundleChecksum, got: %v", err)
+	}
+}
+
+func TestImportFallback_KDFSaltLength(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+
+	oldIterations := bundleIterations
+	bundleIterations = 1000
+	defer func() { bundleIterations = oldIterations }()
+
+	dir := useTempFallbackDir(t)
+	writeFallbackFiles(t, dir, "serial", "uuid")
+
+	bundle, err := ExportFallback("passphrase")
+	if err != nil {
+		t.Fatalf("ExportFallback() failed: %v", err)
+	}
+
+	var b fallbackBundle
+	if err := json.Unmarshal(bundle, &b); err != nil {
+		t.Fatal(err)
+	}
+	for _, salt := range [][]byte{nil, b.KDFSalt[:4]} {
+		b.KDFSalt = salt
+		crafted, _ := json.Marshal(b)
+		if err := ImportFallback(crafted, "passphrase", true); !errors.Is(err, ErrBundleFormat) {
+			t.Errorf("ImportFallback() with %d-byte KDF salt expected ErrBundleFormat, got: %v", len(salt), err)
+		}
+	}
+}
+
+func TestInstallFallbackFiles_RollsBack(t *testing.T) {
+	dir := useTempFallbackDir(t)
+	if err := os.MkdirAll(filepath.Join(dir, fallbackUUIDFile, "blocked"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, fallbackSerialFile), []byte("old-serial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The UUID file cannot be replaced, so the serial must not change either
+	if err := installFallbackFiles("new-serial", "new-uuid"); err == nil {
+		t.Fatal("installFallbackFiles() should fail when the UUID file cannot be replaced")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, fallbackSerialFile))
+	if err != nil || string(data) != "old-serial" {
+		t.Errorf("serial file = %q, %v; expected the old serial to be restored", data, err)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, ".*.tmp-*"))
+	if len(matches) != 0 {
+		t.Errorf("installFallbackFiles() left temporary files: %v", matches)
+	}
+}
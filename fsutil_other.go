@@ -0,0 +1,14 @@
+//go:build !unix
+
+package machid
+
+import "io/fs"
+
+// oNoFollow is not supported on this platform; symlinks are still rejected
+// by the Lstat checks in the cache path validation.
+const oNoFollow = 0
+
+// fileOwner is not supported on this platform.
+func fileOwner(fi fs.FileInfo) (uid int, ok bool) {
+	return 0, false
+}
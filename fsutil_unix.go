@@ -0,0 +1,20 @@
+//go:build unix
+
+package machid
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// oNoFollow makes open(2) fail on symlinks
+const oNoFollow = syscall.O_NOFOLLOW
+
+// fileOwner returns the owning UID of a file.
+func fileOwner(fi fs.FileInfo) (uid int, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(st.Uid), true
+}
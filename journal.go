@@ -0,0 +1,635 @@
+package machid
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ================================================================================
+// Metering Counters and Journal
+// ================================================================================
+//
+// Named counters (e.g. "api_calls", "exports") are kept in an append-only
+// journal per cache namespace instead of cache.json. Every record carries the
+// hash of its predecessor, and checkpoint records with the values of all
+// counters are appended periodically. The journal tip is anchored in the
+// watermark store (see SetWatermarkStore), so rewriting or truncating the
+// journal to rewind a counter is detected by VerifyJournal. A checkpoint kept
+// elsewhere (e.g. by a licensing server) detects rewinds of both.
+//
+// The hash chain is not keyed: anyone able to write the journal can rebuild a
+// consistent one. Rewinds are therefore only detected through the anchor,
+// which must live apart from the journal (the kernel keyring by default); if
+// no watermark store is available, only edits that break the chain are.
+//
+// Once a journal holds more than journalCompactRecords records, it is
+// compacted at the next checkpoint: the file is replaced by that checkpoint
+// record alone, which continues the chain, so appends stay cheap and the file
+// stays small.
+
+// Journal errors
+var (
+	// ErrEmptyCounter is returned when a counter name is empty
+	ErrEmptyCounter = errors.New("machid: empty counter name")
+
+	// ErrZeroIncrement is returned when a counter is incremented by zero
+	ErrZeroIncrement = errors.New("machid: counter increment must be positive")
+
+	// ErrJournalTampered is returned when the journal's hash chain or counter
+	// values do not check out
+	ErrJournalTampered = errors.New("machid: counter journal tampered")
+
+	// ErrJournalRewound is returned when the journal ends before a record it
+	// is known to have contained
+	ErrJournalRewound = errors.New("machid: counter journal rewound")
+)
+
+// Counter names a metering counter.
+type Counter string
+
+// ActionCounter is the counter IncrementActionCount records to if enabled with
+// SetActionJournal. Unlike the cached ActionCount, it is not reset when the
+// eMachID is rotated.
+const ActionCounter Counter = "actions"
+
+// DefaultCheckpointInterval is the number of counter records between checkpoints
+const DefaultCheckpointInterval = 100
+
+var (
+	// journalDir overrides the default journal directory when non-empty
+	journalDir   string
+	journalDirMu sync.RWMutex
+
+	checkpointInterval   = DefaultCheckpointInterval
+	checkpointIntervalMu sync.RWMutex
+
+	// actionJournal enables journaling of IncrementActionCount
+	actionJournal   bool
+	actionJournalMu sync.RWMutex
+
+	// journalMu serializes journal appends within the process
+	journalMu sync.Mutex
+
+	// Journal directory inside the per-user cache directory
+	journalSubDir = "journal"
+
+	// journalCompactRecords is the journal length beyond which it is
+	// compacted at the next checkpoint
+	journalCompactRecords = 10 * DefaultCheckpointInterval
+)
+
+// JournalCheckpoint is the state of a namespace's counters at a journal record.
+// Keep checkpoints returned by Checkpoint to detect later rewinds with VerifyJournal.
+type JournalCheckpoint struct {
+	Namespace string             `json:"namespace"`
+	Seq       uint64             `json:"seq"`  // Sequence number of the record
+	Hash      string             `json:"hash"` // Hash of the record (the chain tip)
+	Time      time.Time          `json:"time"`
+	Counters  map[Counter]uint64 `json:"counters"`
+}
+
+// journalRecord is a single line in a journal file: a counter increment, or a
+// checkpoint of all counters.
+type journalRecord struct {
+	Seq        uint64             `json:"seq"`
+	Time       int64              `json:"time"` // Unix nanoseconds
+	Counter    Counter            `json:"counter,omitempty"`
+	Delta      uint64             `json:"delta,omitempty"`
+	Value      uint64             `json:"value,omitempty"` // Counter value after the increment
+	Checkpoint map[Counter]uint64 `json:"checkpoint,omitempty"`
+	Prev       string             `json:"prev"`
+	Hash       string             `json:"hash"`
+}
+
+// journalState is the verified content of a journal. After a compaction the
+// first record is a checkpoint with a sequence number above 1.
+type journalState struct {
+	records    []journalRecord
+	counters   map[Counter]uint64
+	sinceCheck int   // Counter records since the last checkpoint
+	size       int64 // Length of the journal without a torn final line
+}
+
+// SetJournalDir sets the directory the counter journals are kept in.
+// Pass an empty string to restore the default (~/.config/machid/journal).
+func SetJournalDir(dir string) {
+	journalDirMu.Lock()
+	defer journalDirMu.Unlock()
+	journalDir = dir
+}
+
+// GetJournalDir returns the directory the counter journals are kept in.
+func GetJournalDir() string {
+	journalDirMu.RLock()
+	defer journalDirMu.RUnlock()
+	if journalDir != "" {
+		return journalDir
+	}
+	return filepath.Join(getCacheDir(), journalSubDir)
+}
+
+// SetActionJournal enables or disables recording IncrementActionCount to
+// ActionCounter in the counter journal. It is disabled by default, since the
+// journal is a file even when the cache is kept elsewhere (e.g. in memory or
+// the kernel keyring).
+//
+// Parameters:
+//   - enabled: true to journal action counts
+func SetActionJournal(enabled bool) {
+	actionJournalMu.Lock()
+	defer actionJournalMu.Unlock()
+	actionJournal = enabled
+}
+
+// IsActionJournal returns whether IncrementActionCount is journaled.
+func IsActionJournal() bool {
+	actionJournalMu.RLock()
+	defer actionJournalMu.RUnlock()
+	return actionJournal
+}
+
+// SetCheckpointInterval sets after how many counter records a checkpoint is
+// appended to the journal. Values below 1 restore DefaultCheckpointInterval.
+func SetCheckpointInterval(n int) {
+	checkpointIntervalMu.Lock()
+	defer checkpointIntervalMu.Unlock()
+	if n < 1 {
+		n = DefaultCheckpointInterval
+	}
+	checkpointInterval = n
+}
+
+// GetCheckpointInterval returns the number of counter records between checkpoints.
+func GetCheckpointInterval() int {
+	checkpointIntervalMu.RLock()
+	defer checkpointIntervalMu.RUnlock()
+	return checkpointInterval
+}
+
+// journalPath returns the journal file of namespace name.
+func journalPath(name string) string {
+	return filepath.Join(GetJournalDir(), url.PathEscape(name)+".jsonl")
+}
+
+// prepareJournalDir creates the journal directory. The default location is
+// hardened like the cache directory.
+func prepareJournalDir() error {
+	journalDirMu.RLock()
+	custom := journalDir != ""
+	journalDirMu.RUnlock()
+
+	if !custom {
+		if home, ok := getCacheHome(); ok {
+			_, err := secureCacheDir(home, filepath.Join(cacheSubDir, journalSubDir))
+			return err
+		}
+	}
+	return os.MkdirAll(GetJournalDir(), 0700)
+}
+
+// hash returns the chain hash of the record.
+func (r journalRecord) hash() string {
+	r.Hash = ""
+	data, _ := json.Marshal(r)
+	sum := sha256.Sum256(append([]byte("machid journal\x00"), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+// readJournal reads and verifies the journal of namespace name. A missing
+// journal is empty. A torn final line (e.g. from a crash) is ignored.
+func readJournal(name string) (*journalState, error) {
+	state := &journalState{counters: make(map[Counter]uint64)}
+
+	data, err := os.ReadFile(journalPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+
+	// Only complete lines count; a torn final line is dropped on the next append
+	complete := data[:bytes.LastIndexByte(data, '\n')+1]
+	state.size = int64(len(complete))
+
+	prev := ""
+	for i, line := range bytes.Split(bytes.TrimSuffix(complete, []byte("\n")), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var r journalRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return nil, fmt.Errorf("%w: unreadable record on line %d", ErrJournalTampered, i+1)
+		}
+
+		// A compacted journal starts with a checkpoint continuing the chain
+		if len(state.records) == 0 && r.Seq > 1 && r.Checkpoint != nil && r.Hash == r.hash() {
+			state.counters = maps.Clone(r.Checkpoint)
+			state.records = append(state.records, r)
+			prev = r.Hash
+			continue
+		}
+
+		if r.Seq != state.nextSeq() || r.Prev != prev || r.Hash != r.hash() {
+			return nil, fmt.Errorf("%w: hash chain broken at record %d", ErrJournalTampered, r.Seq)
+		}
+		if r.Checkpoint != nil {
+			if !maps.Equal(r.Checkpoint, state.counters) {
+				return nil, fmt.Errorf("%w: checkpoint %d does not match the counters", ErrJournalTampered, r.Seq)
+			}
+			state.sinceCheck = 0
+		} else {
+			state.counters[r.Counter] += r.Delta
+			if r.Counter == "" || r.Delta == 0 || r.Value != state.counters[r.Counter] {
+				return nil, fmt.Errorf("%w: invalid counter record %d", ErrJournalTampered, r.Seq)
+			}
+			state.sinceCheck++
+		}
+
+		state.records = append(state.records, r)
+		prev = r.Hash
+	}
+	return state, nil
+}
+
+// readVerifiedJournal reads the journal of namespace name and checks that it
+// still contains the tip anchored in the watermark store.
+func readVerifiedJournal(name string) (*journalState, error) {
+	state, err := readJournal(name)
+	if err != nil {
+		return nil, err
+	}
+	seq, hash, err := journalAnchor(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := state.contains(seq, hash); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// first returns the sequence number of the first record (0 if empty).
+func (s *journalState) first() uint64 {
+	if len(s.records) == 0 {
+		return 0
+	}
+	return s.records[0].Seq
+}
+
+// nextSeq returns the sequence number of the next record.
+func (s *journalState) nextSeq() uint64 {
+	if len(s.records) == 0 {
+		return 1
+	}
+	return s.records[len(s.records)-1].Seq + 1
+}
+
+// contains checks that the journal holds the record at seq with the given
+// hash. A journal ending before seq was rewound; a different hash means the
+// record was rewritten. Since the anchor always points at the tip, a journal
+// compacted past an anchored seq was rewritten too.
+func (s *journalState) contains(seq uint64, hash string) error {
+	if seq == 0 {
+		return nil
+	}
+	if seq >= s.nextSeq() {
+		return fmt.Errorf("%w: record %d is missing", ErrJournalRewound, seq)
+	}
+	if seq < s.first() {
+		return fmt.Errorf("%w: record %d was compacted away", ErrJournalTampered, seq)
+	}
+	if s.records[seq-s.first()].Hash != hash {
+		return fmt.Errorf("%w: record %d was rewritten", ErrJournalTampered, seq)
+	}
+	return nil
+}
+
+// containsCheckpoint checks that the journal contains an earlier checkpoint.
+// A checkpoint that was compacted away is checked against the counters of the
+// compacted journal's first checkpoint instead, since counters never decrease.
+func (s *journalState) containsCheckpoint(cp *JournalCheckpoint) error {
+	if cp.Seq == 0 || cp.Seq >= s.first() {
+		return s.contains(cp.Seq, cp.Hash)
+	}
+	for counter, value := range cp.Counters {
+		if s.records[0].Checkpoint[counter] < value {
+			return fmt.Errorf("%w: counter %q is below checkpoint %d", ErrJournalRewound, counter, cp.Seq)
+		}
+	}
+	return nil
+}
+
+// compactable reports whether the journal ends in a checkpoint and has grown
+// beyond journalCompactRecords, so it can be replaced by that checkpoint.
+func (s *journalState) compactable() bool {
+	n := len(s.records)
+	return n > journalCompactRecords && s.records[n-1].Checkpoint != nil
+}
+
+// tip returns the hash of the last record, or "" for an empty journal.
+func (s *journalState) tip() string {
+	if len(s.records) == 0 {
+		return ""
+	}
+	return s.records[len(s.records)-1].Hash
+}
+
+// checkpoint returns the state at the last record.
+func (s *journalState) checkpoint(name string) *JournalCheckpoint {
+	cp := &JournalCheckpoint{Namespace: name, Counters: maps.Clone(s.counters)}
+	if n := len(s.records); n > 0 {
+		cp.Seq, cp.Hash, cp.Time = s.records[n-1].Seq, s.records[n-1].Hash, time.Unix(0, s.records[n-1].Time)
+	}
+	return cp
+}
+
+// append chains r to the journal state and returns it.
+func (s *journalState) append(r journalRecord) journalRecord {
+	r.Seq = s.nextSeq()
+	r.Prev = s.tip()
+	r.Hash = r.hash()
+	s.records = append(s.records, r)
+	return r
+}
+
+// journalAnchor returns the journal tip recorded in the watermark store for
+// namespace name.
+func journalAnchor(name string) (seq uint64, hash string, err error) {
+	mark, err := loadWatermark(activeWatermarkStore())
+	if err != nil || mark == nil {
+		return 0, "", err
+	}
+	entry := mark.Namespaces[name]
+	return entry.JournalSeq, entry.JournalHash, nil
+}
+
+// anchorJournal records the journal tip of namespace name in the watermark store.
+func anchorJournal(name string, seq uint64, hash string) error {
+	store := activeWatermarkStore()
+	if store == nil {
+		return nil
+	}
+
+	unlock, err := lockCacheStore(store)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	mark, err := loadWatermark(store)
+	if err != nil {
+		return err
+	}
+	if mark == nil {
+		mark = &watermark{}
+	}
+	if mark.Namespaces == nil {
+		mark.Namespaces = make(map[string]watermarkEntry)
+	}
+	entry := mark.Namespaces[name]
+	entry.JournalSeq, entry.JournalHash = seq, hash
+	mark.Namespaces[name] = entry
+
+	data, err := json.Marshal(mark)
+	if err != nil {
+		return err
+	}
+	return store.Save(data)
+}
+
+// openJournal opens and locks the journal file at path. Since compaction
+// replaces the file, the lock is retried until it is held on the file that is
+// currently at path.
+func openJournal(path string) (*os.File, error) {
+	for {
+		if err := checkCacheFile(path); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|oNoFollow, 0600)
+		if err != nil {
+			return nil, err
+		}
+		chownToCacheOwner(path)
+
+		if err := lockFile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		locked, statErr := f.Stat()
+		current, err := os.Lstat(path)
+		if statErr == nil && err == nil && os.SameFile(locked, current) {
+			return f, nil
+		}
+		unlockFile(f)
+		f.Close()
+		if statErr != nil {
+			return nil, statErr
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// updateJournal verifies the journal of namespace name against its anchor,
+// lets fn append records, and writes and anchors them. A journal that became
+// compactable is replaced by its final checkpoint instead.
+func updateJournal(name string, fn func(state *journalState) []journalRecord) (*journalState, error) {
+	if err := checkWritable(); err != nil {
+		return nil, err
+	}
+	journalMu.Lock()
+	defer journalMu.Unlock()
+
+	if err := prepareJournalDir(); err != nil {
+		return nil, err
+	}
+	path := journalPath(name)
+	f, err := openJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	defer unlockFile(f)
+
+	state, err := readJournal(name)
+	if err != nil {
+		return nil, err
+	}
+	seq, hash, err := journalAnchor(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := state.contains(seq, hash); err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(state.size); err != nil {
+		return nil, err
+	}
+
+	data, err := encodeJournalRecords(fn(state))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Truncate(state.size)
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Truncate(state.size)
+		return nil, err
+	}
+
+	// The records only count once anchored: undo the append otherwise, so
+	// a caller retrying the failed update does not count it twice
+	last := state.records[len(state.records)-1]
+	if err := anchorJournal(name, last.Seq, last.Hash); err != nil {
+		if truncErr := f.Truncate(state.size); truncErr == nil {
+			f.Sync()
+		}
+		return nil, err
+	}
+
+	// Compact only after the tip is anchored, so the anchor always names
+	// the record a compacted journal starts with
+	if state.compactable() {
+		if err := compactJournal(path, state); err != nil {
+			logWarning(fmt.Sprintf("WARNING: machid - Failed to compact counter journal: %v", err))
+		}
+	}
+	return state, nil
+}
+
+// encodeJournalRecords encodes records as journal lines.
+func encodeJournalRecords(records []journalRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, r := range records {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(append(data, '\n'))
+	}
+	return buf.Bytes(), nil
+}
+
+// compactJournal replaces the journal at path by its final checkpoint. Other
+// processes notice the replaced file when they lock it (see openJournal).
+func compactJournal(path string, state *journalState) error {
+	data, err := encodeJournalRecords(state.records[len(state.records)-1:])
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return err
+	}
+	chownToCacheOwner(path)
+	state.records = state.records[len(state.records)-1:]
+	state.size = int64(len(data))
+	return nil
+}
+
+// incrementCounter adds n to counter in the journal of namespace name.
+func incrementCounter(name string, counter Counter, n uint64) (uint64, error) {
+	if counter == "" {
+		return 0, ErrEmptyCounter
+	}
+	if n == 0 {
+		return 0, ErrZeroIncrement
+	}
+
+	interval := GetCheckpointInterval()
+	t := now().UnixNano()
+	state, err := updateJournal(name, func(state *journalState) []journalRecord {
+		state.counters[counter] += n
+		records := []journalRecord{state.append(journalRecord{
+			Time: t, Counter: counter, Delta: n, Value: state.counters[counter],
+		})}
+		if state.sinceCheck++; state.sinceCheck >= interval {
+			records = append(records, state.append(journalRecord{Time: t, Checkpoint: maps.Clone(state.counters)}))
+			state.sinceCheck = 0
+		}
+		return records
+	})
+	if err != nil {
+		return 0, err
+	}
+	return state.counters[counter], nil
+}
+
+// IncrementCounter adds n to a named counter of the current cache namespace
+// and returns its new value. The increment is appended to the namespace's
+// journal, which is verified first.
+//
+// Parameters:
+//   - counter: The counter name, e.g. "api_calls"
+//   - n: The amount to add (must be positive)
+//
+// Returns:
+//   - The new counter value
+//   - ErrEmptyCounter, ErrNoWriteMode, or an error wrapping ErrJournalTampered
+//     or ErrJournalRewound if the journal fails verification
+func IncrementCounter(counter Counter, n uint64) (uint64, error) {
+	return incrementCounter(currentNamespace(), counter, n)
+}
+
+// Checkpoint appends a checkpoint of all counters of the current cache
+// namespace to its journal and returns it. Keep the checkpoint (e.g. on a
+// licensing server) to detect a later rewind with VerifyJournal.
+func Checkpoint() (*JournalCheckpoint, error) {
+	name := currentNamespace()
+	t := now().UnixNano()
+	state, err := updateJournal(name, func(state *journalState) []journalRecord {
+		state.sinceCheck = 0
+		return []journalRecord{state.append(journalRecord{Time: t, Checkpoint: maps.Clone(state.counters)})}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return state.checkpoint(name), nil
+}
+
+// VerifyJournal verifies the journal of the current cache namespace: its hash
+// chain, its checkpoints, that it still contains the tip anchored in the
+// watermark store, and that it contains each of the given checkpoints.
+//
+// Parameters:
+//   - checkpoints: Checkpoints obtained earlier (optional)
+//
+// Returns:
+//   - The current state of all counters
+//   - An error wrapping ErrJournalTampered or ErrJournalRewound if verification fails
+func VerifyJournal(checkpoints ...*JournalCheckpoint) (*JournalCheckpoint, error) {
+	name := currentNamespace()
+	state, err := readVerifiedJournal(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, cp := range checkpoints {
+		if err := state.containsCheckpoint(cp); err != nil {
+			return nil, err
+		}
+	}
+	return state.checkpoint(name), nil
+}
+
+// GetCounter returns the verified value of a named counter of the current
+// cache namespace (0 if it was never incremented).
+func GetCounter(counter Counter) (uint64, error) {
+	cp, err := VerifyJournal()
+	if err != nil {
+		return 0, err
+	}
+	return cp.Counters[counter], nil
+}
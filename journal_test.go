@@ -0,0 +1,219 @@
+package machid
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIncrementCounter(t *testing.T) {
+	useMemoryCacheStore(t)
+	SetCheckpointInterval(3)
+	t.Cleanup(func() { SetCheckpointInterval(0) })
+
+	for i := range 4 {
+		if value, err := IncrementCounter("api_calls", 2); err != nil || value != uint64(2*(i+1)) {
+			t.Fatalf("IncrementCounter(api_calls) = %d, %v", value, err)
+		}
+	}
+	if value, err := IncrementCounter("exports", 1); err != nil || value != 1 {
+		t.Fatalf("IncrementCounter(exports) = %d, %v", value, err)
+	}
+	if _, err := IncrementCounter("", 1); !errors.Is(err, ErrEmptyCounter) {
+		t.Errorf("IncrementCounter() with empty name expected ErrEmptyCounter, got: %v", err)
+	}
+	if _, err := IncrementCounter("exports", 0); !errors.Is(err, ErrZeroIncrement) {
+		t.Errorf("IncrementCounter() by zero expected ErrZeroIncrement, got: %v", err)
+	}
+
+	state, err := readJournal(currentNamespace())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoints := 0
+	for _, r := range state.records {
+		if r.Checkpoint != nil {
+			checkpoints++
+		}
+	}
+	if len(state.records) != 6 || checkpoints != 1 {
+		t.Errorf("journal has %d records and %d checkpoints; expected 6 and 1", len(state.records), checkpoints)
+	}
+
+	cp, err := VerifyJournal()
+	if err != nil || cp.Counters["api_calls"] != 8 || cp.Counters["exports"] != 1 || cp.Seq != 6 {
+		t.Errorf("VerifyJournal() = %+v, %v", cp, err)
+	}
+
+	// Namespaces keep separate counters
+	SetCacheNamespace("other")
+	if value, _ := GetCounter("api_calls"); value != 0 {
+		t.Errorf("GetCounter() in another namespace = %d; expected 0", value)
+	}
+}
+
+func TestVerifyJournal_DetectsTampering(t *testing.T) {
+	useMemoryCacheStore(t)
+	for range 3 {
+		if _, err := IncrementCounter("exports", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := journalPath(currentNamespace())
+	original, _ := os.ReadFile(path)
+
+	// Editing a counter value breaks the hash chain
+	os.WriteFile(path, []byte(strings.Replace(string(original), `"value":3`, `"value":1`, 1)), 0600)
+	if _, err := VerifyJournal(); !errors.Is(err, ErrJournalTampered) {
+		t.Errorf("VerifyJournal() after edit expected ErrJournalTampered, got: %v", err)
+	}
+
+	// Truncating the journal falls behind the anchored tip
+	lines := strings.SplitAfter(string(original), "\n")
+	os.WriteFile(path, []byte(lines[0]), 0600)
+	if _, err := VerifyJournal(); !errors.Is(err, ErrJournalRewound) {
+		t.Errorf("VerifyJournal() after truncation expected ErrJournalRewound, got: %v", err)
+	}
+	if _, err := IncrementCounter("exports", 1); !errors.Is(err, ErrJournalRewound) {
+		t.Errorf("IncrementCounter() on rewound journal expected ErrJournalRewound, got: %v", err)
+	}
+
+	// A torn final line is dropped on the next append
+	os.WriteFile(path, append(original, `{"seq":4,"ti`...), 0600)
+	if value, err := IncrementCounter("exports", 1); err != nil || value != 4 {
+		t.Errorf("IncrementCounter() after torn write = %d, %v", value, err)
+	}
+}
+
+func TestVerifyJournal_Checkpoint(t *testing.T) {
+	useMemoryCacheStore(t)
+	IncrementCounter("seats", 5)
+	cp, err := Checkpoint()
+	if err != nil || cp.Counters["seats"] != 5 || cp.Seq != 2 {
+		t.Fatalf("Checkpoint() = %+v, %v", cp, err)
+	}
+	IncrementCounter("seats", 1)
+	if _, err := VerifyJournal(cp); err != nil {
+		t.Errorf("VerifyJournal(checkpoint) failed: %v", err)
+	}
+
+	// Rewinding journal and watermark together is caught by a kept checkpoint
+	os.Remove(journalPath(currentNamespace()))
+	SetWatermarkStore(NewMemoryCacheStore())
+	IncrementCounter("seats", 1)
+	if _, err := VerifyJournal(cp); !errors.Is(err, ErrJournalRewound) {
+		t.Errorf("VerifyJournal(checkpoint) after reset expected ErrJournalRewound, got: %v", err)
+	}
+	IncrementCounter("seats", 1)
+	if _, err := VerifyJournal(cp); !errors.Is(err, ErrJournalTampered) {
+		t.Errorf("VerifyJournal(checkpoint) after rewrite expected ErrJournalTampered, got: %v", err)
+	}
+}
+
+func TestIncrementCounter_Compaction(t *testing.T) {
+	useMemoryCacheStore(t)
+	SetCheckpointInterval(2)
+	journalCompactRecords = 6
+	t.Cleanup(func() {
+		SetCheckpointInterval(0)
+		journalCompactRecords = 10 * DefaultCheckpointInterval
+	})
+
+	IncrementCounter("exports", 1)
+	cp, err := Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 7 {
+		if _, err := IncrementCounter("exports", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state, err := readJournal(currentNamespace())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.first() == 1 || len(state.records) > journalCompactRecords {
+		t.Errorf("journal starts at %d with %d records; expected it to be compacted", state.first(), len(state.records))
+	}
+	if value, err := GetCounter("exports"); err != nil || value != 8 {
+		t.Errorf("GetCounter() after compaction = %d, %v; expected 8", value, err)
+	}
+
+	// Checkpoints compacted away are checked against the counters
+	if _, err := VerifyJournal(cp); err != nil {
+		t.Errorf("VerifyJournal(compacted checkpoint) failed: %v", err)
+	}
+	cp.Counters["exports"] = 100
+	if _, err := VerifyJournal(cp); !errors.Is(err, ErrJournalRewound) {
+		t.Errorf("VerifyJournal(checkpoint ahead of journal) expected ErrJournalRewound, got: %v", err)
+	}
+}
+
+func TestIncrementCounter_AnchorFailure(t *testing.T) {
+	useMemoryCacheStore(t)
+	SetCheckpointInterval(2)
+	journalCompactRecords = 4
+	t.Cleanup(func() {
+		SetCheckpointInterval(0)
+		journalCompactRecords = 10 * DefaultCheckpointInterval
+	})
+
+	marks := NewMemoryCacheStore()
+	failSave := false
+	SetWatermarkStore(&FuncCacheStore{
+		LoadFunc: marks.Load,
+		SaveFunc: func(data []byte) error {
+			if failSave {
+				failSave = false
+				return errors.New("store unavailable")
+			}
+			return marks.Save(data)
+		},
+	})
+
+	// A failed anchor, also of a compacting increment, is not counted
+	for i := range 6 {
+		failSave = i%2 == 1
+		if _, err := IncrementCounter("exports", 1); (err != nil) != (i%2 == 1) {
+			t.Fatalf("IncrementCounter() #%d = %v", i, err)
+		}
+	}
+	if value, err := GetCounter("exports"); err != nil || value != 3 {
+		t.Errorf("GetCounter() = %d, %v; expected 3 after 3 failed increments", value, err)
+	}
+	for range 4 {
+		if _, err := IncrementCounter("exports", 1); err != nil {
+			t.Fatalf("IncrementCounter() after failed anchors: %v", err)
+		}
+	}
+	if state, _ := readJournal(currentNamespace()); state.first() == 1 {
+		t.Error("journal was not compacted")
+	}
+	if _, err := VerifyJournal(); err != nil {
+		t.Errorf("VerifyJournal() after compaction failed: %v", err)
+	}
+}
+
+func TestIncrementActionCount_JournalOptIn(t *testing.T) {
+	useMemoryCacheStore(t)
+	dir := t.TempDir()
+	SetJournalDir(dir)
+	if err := SaveCachedIDs(&CachedMachineIDs{EMachID: "emach"}); err != nil {
+		t.Fatal(err)
+	}
+
+	IncrementActionCount()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("IncrementActionCount() wrote %d journal files without SetActionJournal", len(entries))
+	}
+
+	SetActionJournal(true)
+	t.Cleanup(func() { SetActionJournal(false) })
+	IncrementActionCount()
+	if value, err := GetCounter(ActionCounter); err != nil || value != 1 {
+		t.Errorf("GetCounter(ActionCounter) = %d, %v; expected 1", value, err)
+	}
+}
@@ -0,0 +1,95 @@
+package machid
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"time"
+)
+
+// ================================================================================
+// Linux Kernel Keyring Cache Backend
+// ================================================================================
+//
+// KeyringCacheStore keeps the cache in the Linux kernel keyring instead of a
+// JSON file, so cached IDs never touch disk. When running under sudo, the key is
+// stored in the invoking user's persistent keyring and owned by that user, so
+// unprivileged runs can reuse it ("sudo once, then reuse"). Transactions are
+// serialized across processes with a lock file (holding no data) in the
+// per-user cache directory.
+
+// ErrKeyringUnsupported is returned when the kernel keyring is not available
+var ErrKeyringUnsupported = errors.New("machid: kernel keyring is not supported on this system")
+
+// KeyringType selects which kernel keyring holds the cache.
+type KeyringType int
+
+const (
+	// KeyringPersistent uses the per-UID persistent keyring, which survives
+	// logouts and is shared by all of the user's sessions. Falls back to the
+	// user keyring if the kernel lacks persistent keyring support.
+	KeyringPersistent KeyringType = iota
+
+	// KeyringUser uses the per-UID user keyring, which lives as long as the
+	// user has running processes.
+	KeyringUser
+)
+
+// defaultKeyringDescription is the key description used when none is configured
+const defaultKeyringDescription = "machid:cache"
+
+// KeyringCacheStore stores the cache as a "user" key in the kernel keyring.
+//
+// Keys are created with possessor and owner permissions only (no group or other
+// access). When running as root under sudo/doas/pkexec, the key is placed in the
+// invoking user's keyring and chowned to that user.
+type KeyringCacheStore struct {
+	// Description is the key description. Defaults to "machid:cache".
+	Description string
+
+	// Keyring selects the keyring holding the key. Defaults to KeyringPersistent.
+	Keyring KeyringType
+
+	// Timeout expires the key after the given duration (0 means no expiry).
+	// It is rounded up to whole seconds and reset every time the cache is saved.
+	Timeout time.Duration
+}
+
+// NewKeyringCacheStore returns a keyring store using the persistent keyring
+// and the default key description.
+func NewKeyringCacheStore() *KeyringCacheStore {
+	return &KeyringCacheStore{}
+}
+
+// description returns the key description.
+func (s *KeyringCacheStore) description() string {
+	if s.Description != "" {
+		return s.Description
+	}
+	return defaultKeyringDescription
+}
+
+// timeoutSeconds returns the key timeout in whole seconds for keyctl(2), where
+// 0 means no expiry. Sub-second timeouts are rounded up so they still expire.
+func (s *KeyringCacheStore) timeoutSeconds() uint {
+	if s.Timeout <= 0 {
+		return 0
+	}
+	return uint((s.Timeout + time.Second - 1) / time.Second)
+}
+
+// LockCache takes an exclusive advisory lock on a lock file named after the
+// key description in the per-user cache directory, so processes sharing the
+// key do not lose updates.
+func (s *KeyringCacheStore) LockCache() (func(), error) {
+	if err := checkWritable(); err != nil {
+		return nil, err
+	}
+	dir, err := NewFileCacheStore("").prepareDir()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(s.description()))
+	return lockCachePath(filepath.Join(dir, "keyring-"+hex.EncodeToString(sum[:8])+".lock"))
+}
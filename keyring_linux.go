@@ -0,0 +1,223 @@
+//go:build linux
+
+package machid
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// keyctl(2) operations and special keyring IDs
+const (
+	keySpecProcessKeyring = -2
+	keySpecUserKeyring    = -4
+
+	keyctlGetKeyringID  = 0
+	keyctlChown         = 4
+	keyctlSetPerm       = 5
+	keyctlUnlink        = 9
+	keyctlSearch        = 10
+	keyctlRead          = 11
+	keyctlSetTimeout    = 15
+	keyctlGetPersistent = 22
+
+	// Possessor and owner get full access; group and other get nothing
+	keyPermPossessorAll = 0x3f000000
+	keyPermUserAll      = 0x003f0000
+)
+
+// keyringArg converts a (possibly negative) keyring ID to a syscall argument.
+func keyringArg(id int) uintptr {
+	return uintptr(id)
+}
+
+// keyctl invokes the keyctl(2) system call.
+func keyctl(op int, args ...uintptr) (int, error) {
+	var a [4]uintptr
+	copy(a[:], args)
+	r, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, uintptr(op), a[0], a[1], a[2], a[3], 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+// addKey invokes the add_key(2) system call for a "user" key.
+func addKey(description string, payload []byte, keyring int) (int, error) {
+	keyType, err := syscall.BytePtrFromString("user")
+	if err != nil {
+		return -1, err
+	}
+	desc, err := syscall.BytePtrFromString(description)
+	if err != nil {
+		return -1, err
+	}
+	var payloadPtr unsafe.Pointer
+	if len(payload) > 0 {
+		payloadPtr = unsafe.Pointer(&payload[0])
+	}
+	r, _, errno := syscall.Syscall6(syscall.SYS_ADD_KEY,
+		uintptr(unsafe.Pointer(keyType)), uintptr(unsafe.Pointer(desc)),
+		uintptr(payloadPtr), uintptr(len(payload)), uintptr(keyring), 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+// keyringOwner returns the UID whose keyring should hold the cache: the
+// invoking user when running as root under sudo/doas/pkexec, otherwise the
+// current user.
+func keyringOwner() int {
+	uid, _ := cacheOwner()
+	return uid
+}
+
+// keyringID resolves the serial number of the target keyring.
+func (s *KeyringCacheStore) keyringID(uid int) (int, error) {
+	if s.Keyring == KeyringPersistent {
+		id, err := keyctl(keyctlGetPersistent, uintptr(uid), keyringArg(keySpecProcessKeyring))
+		if err == nil {
+			return id, nil
+		}
+		if !errors.Is(err, syscall.EOPNOTSUPP) {
+			return -1, keyringError("get persistent keyring", err)
+		}
+		// Kernel built without persistent keyrings - use the user keyring
+	}
+
+	if uid != os.Geteuid() {
+		// The user keyring of another UID is not reachable from this process
+		return -1, fmt.Errorf("machid: cannot access the user keyring of uid %d (use KeyringPersistent)", uid)
+	}
+	id, err := keyctl(keyctlGetKeyringID, keyringArg(keySpecUserKeyring), 1)
+	if err != nil {
+		return -1, keyringError("get user keyring", err)
+	}
+	return id, nil
+}
+
+// search returns the serial of the cache key, or an error wrapping
+// fs.ErrNotExist if it does not exist or has expired.
+func (s *KeyringCacheStore) search(keyring int) (int, error) {
+	keyType, err := syscall.BytePtrFromString("user")
+	if err != nil {
+		return -1, err
+	}
+	desc, err := syscall.BytePtrFromString(s.description())
+	if err != nil {
+		return -1, err
+	}
+	id, err := keyctl(keyctlSearch, uintptr(keyring), uintptr(unsafe.Pointer(keyType)), uintptr(unsafe.Pointer(desc)), 0)
+	if err != nil {
+		return -1, keyringError("search key", err)
+	}
+	return id, nil
+}
+
+// keyringAvailable reports whether this process can use the kernel keyring.
+// The result is probed once.
+var keyringAvailable = sync.OnceValue(func() bool {
+	_, err := keyctl(keyctlGetKeyringID, keyringArg(keySpecUserKeyring), 1)
+	return err == nil
+})
+
+// keyringError maps keyctl errors to library errors.
+func keyringError(op string, err error) error {
+	switch {
+	case errors.Is(err, syscall.ENOKEY), errors.Is(err, syscall.EKEYEXPIRED), errors.Is(err, syscall.EKEYREVOKED):
+		return fmt.Errorf("machid: keyring %s: %w", op, fs.ErrNotExist)
+	case errors.Is(err, syscall.ENOSYS):
+		return fmt.Errorf("%w: %s: %v", ErrKeyringUnsupported, op, err)
+	default:
+		return fmt.Errorf("machid: keyring %s: %w", op, err)
+	}
+}
+
+// Load reads the cache key from the keyring.
+func (s *KeyringCacheStore) Load() ([]byte, error) {
+	keyring, err := s.keyringID(keyringOwner())
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.search(keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	// Query the payload size, then read it
+	size, err := keyctl(keyctlRead, uintptr(key), 0, 0)
+	if err != nil {
+		return nil, keyringError("read key", err)
+	}
+	for {
+		buf := make([]byte, size)
+		var bufPtr unsafe.Pointer
+		if size > 0 {
+			bufPtr = unsafe.Pointer(&buf[0])
+		}
+		n, err := keyctl(keyctlRead, uintptr(key), uintptr(bufPtr), uintptr(size))
+		if err != nil {
+			return nil, keyringError("read key", err)
+		}
+		if n <= size {
+			return buf[:n], nil
+		}
+		// The key was updated between the two calls - retry with the new size
+		clear(buf)
+		size = n
+	}
+}
+
+// Save stores data in the keyring, replacing any previous cache key.
+func (s *KeyringCacheStore) Save(data []byte) error {
+	uid := keyringOwner()
+	keyring, err := s.keyringID(uid)
+	if err != nil {
+		return err
+	}
+
+	key, err := addKey(s.description(), data, keyring)
+	if err != nil {
+		return keyringError("add key", err)
+	}
+
+	// Hand the key to the invoking user when running as root under sudo
+	if uid != os.Geteuid() {
+		if _, err := keyctl(keyctlChown, uintptr(key), uintptr(uid), ^uintptr(0)); err != nil {
+			return keyringError("chown key", err)
+		}
+	}
+	if _, err := keyctl(keyctlSetPerm, uintptr(key), keyPermPossessorAll|keyPermUserAll); err != nil {
+		return keyringError("set key permissions", err)
+	}
+	if _, err := keyctl(keyctlSetTimeout, uintptr(key), uintptr(s.timeoutSeconds())); err != nil {
+		return keyringError("set key timeout", err)
+	}
+
+	return nil
+}
+
+// Clear removes the cache key from the keyring.
+func (s *KeyringCacheStore) Clear() error {
+	keyring, err := s.keyringID(keyringOwner())
+	if err != nil {
+		return err
+	}
+	key, err := s.search(keyring)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if _, err := keyctl(keyctlUnlink, uintptr(key), uintptr(keyring)); err != nil {
+		return keyringError("unlink key", err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+//go:build linux
+
+package machid
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestKeyringStore returns a keyring store with a unique description, or
+// skips the test if the kernel keyring is not usable in this environment.
+func newTestKeyringStore(t *testing.T, keyring KeyringType) *KeyringCacheStore {
+	t.Helper()
+	store := &KeyringCacheStore{
+		Description: fmt.Sprintf("machid:test:%d:%s", os.Getpid(), t.Name()),
+		Keyring:     keyring,
+	}
+	if err := store.Save([]byte("probe")); err != nil {
+		if errors.Is(err, ErrKeyringUnsupported) || errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+			t.Skipf("kernel keyring not available: %v", err)
+		}
+		t.Fatalf("Save() failed: %v", err)
+	}
+	t.Cleanup(func() { store.Clear() })
+	return store
+}
+
+func TestKeyringCacheStore_RoundTrip(t *testing.T) {
+	for _, keyring := range []KeyringType{KeyringPersistent, KeyringUser} {
+		store := newTestKeyringStore(t, keyring)
+
+		if err := store.Save([]byte(`{"remach_id":"abc"}`)); err != nil {
+			t.Fatalf("Save() failed: %v", err)
+		}
+		data, err := store.Load()
+		if err != nil || string(data) != `{"remach_id":"abc"}` {
+			t.Errorf("Load() = %q, %v", data, err)
+		}
+
+		if err := store.Clear(); err != nil {
+			t.Fatalf("Clear() failed: %v", err)
+		}
+		if _, err := store.Load(); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Load() after Clear() expected fs.ErrNotExist, got: %v", err)
+		}
+		// Clearing an empty store is not an error
+		if err := store.Clear(); err != nil {
+			t.Errorf("Clear() on empty store failed: %v", err)
+		}
+	}
+}
+
+func TestKeyringCacheStore_Timeout(t *testing.T) {
+	store := newTestKeyringStore(t, KeyringUser)
+	store.Timeout = time.Second
+
+	if err := store.Save([]byte("expiring")); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+
+	if _, err := store.Load(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load() after timeout expected fs.ErrNotExist, got: %v", err)
+	}
+}
+
+func TestKeyringKeyProvider(t *testing.T) {
+	store := newTestKeyringStore(t, KeyringUser)
+	store.Clear()
+
+	provider := &KeyringKeyProvider{Description: store.Description, Keyring: KeyringUser}
+	key, err := provider.CacheKey()
+	if err != nil || len(key) != 32 {
+		t.Fatalf("CacheKey() = %d bytes, %v", len(key), err)
+	}
+	again, err := provider.CacheKey()
+	if err != nil || string(again) != string(key) {
+		t.Errorf("CacheKey() returned a different key on the second call: %v", err)
+	}
+}
+
+func TestKeyringKeyProvider_KeyMissing(t *testing.T) {
+	store := newTestKeyringStore(t, KeyringUser)
+	store.Clear()
+	useMemoryCacheStore(t)
+	useCacheEncryption(t, &KeyringKeyProvider{Description: store.Description, Keyring: KeyringUser})
+
+	if _, _, err := GetOrGenerateEMachID("test-salt"); err != nil {
+		t.Fatalf("GetOrGenerateEMachID() failed: %v", err)
+	}
+
+	// The key expires while the encrypted cache still exists
+	if err := store.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadCachedIDs()
+	if !errors.Is(err, ErrCacheKeyMissing) || !errors.Is(err, ErrCacheDecrypt) {
+		t.Errorf("LoadCachedIDs() without the keyring key expected ErrCacheKeyMissing, got: %v", err)
+	}
+	if _, err := store.Load(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("a new key was created for an existing encrypted cache: %v", err)
+	}
+}
+
+func TestKeyringCacheStore_TimeoutSeconds(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    uint
+	}{
+		{0, 0},
+		{-time.Second, 0},
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{time.Minute, 60},
+	}
+	for _, tt := range tests {
+		store := &KeyringCacheStore{Timeout: tt.timeout}
+		if got := store.timeoutSeconds(); got != tt.want {
+			t.Errorf("timeoutSeconds(%v) = %d, expected %d", tt.timeout, got, tt.want)
+		}
+	}
+}
+
+func TestKeyringCacheStore_LockCache(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	for _, env := range []string{"SUDO_UID", "SUDO_USER", "DOAS_USER", "PKEXEC_UID"} {
+		t.Setenv(env, "")
+	}
+
+	var locker CacheLocker = &KeyringCacheStore{Description: "machid:test-lock"}
+	unlock, err := locker.LockCache()
+	if err != nil {
+		t.Fatalf("LockCache() failed: %v", err)
+	}
+	unlock()
+
+	matches, _ := filepath.Glob(filepath.Join(home, cacheSubDir, "keyring-*.lock"))
+	if len(matches) != 1 {
+		t.Errorf("LockCache() should create one lock file in the cache directory, found %v", matches)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package machid
+
+// keyringAvailable reports whether the kernel keyring can be used (never on
+// this platform).
+func keyringAvailable() bool {
+	return false
+}
+
+// Load is not supported on this platform.
+func (s *KeyringCacheStore) Load() ([]byte, error) {
+	return nil, ErrKeyringUnsupported
+}
+
+// Save is not supported on this platform.
+func (s *KeyringCacheStore) Save(data []byte) error {
+	return ErrKeyringUnsupported
+}
+
+// Clear is not supported on this platform.
+func (s *KeyringCacheStore) Clear() error {
+	return ErrKeyringUnsupported
+}
@@ -0,0 +1,302 @@
+package machid
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ================================================================================
+// Machine Identity Ledger
+// ================================================================================
+//
+// The ledger is an append-only, root-only file recording every distinct reMachID
+// the host has produced, together with the identifier sources it was derived
+// from and the reason it changed. Support staff can use it to confirm that an
+// old reMachID (e.g. from before a motherboard swap) belongs to this machine.
+//
+// The default ledger lives in the fallback directory and is only written when
+// that directory already exists (i.e. the host uses or used fallback files),
+// so hosts with hardware identifiers never gain an /etc/.machid directory.
+// Setting a path with SetLedgerPath enables the ledger on every host.
+
+// Ledger reasons
+const (
+	// LedgerReasonFirstSeen is recorded for the first reMachID in the ledger.
+	LedgerReasonFirstSeen = "first reMachID recorded on this host"
+
+	// LedgerReasonSeen is recorded when a known reMachID is produced again.
+	LedgerReasonSeen = "reMachID seen again"
+
+	// LedgerReasonNewSalt is recorded when known identifiers produce a new
+	// reMachID because a different salt was used.
+	LedgerReasonNewSalt = "same identifiers, different salt"
+
+	// LedgerReasonSourcesChanged is recorded when a reMachID is now derived
+	// from different identifier sources than when it was last recorded.
+	LedgerReasonSourcesChanged = "identifier sources changed"
+
+	// LedgerReasonIdentifiersChanged is recorded when the identifier values
+	// changed while the sources stayed the same (e.g. a motherboard swap).
+	LedgerReasonIdentifiersChanged = "identifier values changed"
+
+	// LedgerReasonMigration is recorded while the host is migrating from
+	// fallback to hardware identifiers (see MigrationPolicy).
+	LedgerReasonMigration = "fallback-to-hardware migration"
+)
+
+// ledgerSeenInterval is how often a "seen again" record is appended for a
+// reMachID that is already in the ledger.
+var ledgerSeenInterval = 24 * time.Hour
+
+var (
+	// ledgerPath overrides the default ledger location when non-empty
+	ledgerPath   string
+	ledgerPathMu sync.RWMutex
+
+	// ledgerMu serializes ledger reads and appends within the process
+	ledgerMu sync.Mutex
+
+	// Ledger file name inside the fallback directory
+	ledgerFile = ".mledger"
+
+	// Suffix of the file next to the ledger holding the fingerprint key
+	ledgerKeySuffix = ".key"
+)
+
+// LedgerEntry summarizes every ledger record for a single reMachID.
+type LedgerEntry struct {
+	ReMachID  string    `json:"remach_id"`
+	Sources   []string  `json:"sources"`    // Identifier sources the ID was derived from
+	FirstSeen time.Time `json:"first_seen"` // When the ID was first produced
+	LastSeen  time.Time `json:"last_seen"`  // When the ID was last recorded
+	Reason    string    `json:"reason"`     // Why the ID first appeared
+}
+
+// ledgerRecord is a single line in the ledger file.
+type ledgerRecord struct {
+	ReMachID string    `json:"remach_id"`
+	Sources  []string  `json:"sources"`
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason"`
+
+	// Fingerprint is a salt-independent MAC of the identifiers, keyed with
+	// the ledger key, used to tell a salt change apart from a hardware change.
+	Fingerprint string `json:"fingerprint"`
+}
+
+// SetLedgerPath sets the file used for the machine identity ledger and
+// enables the ledger on hosts that do not use fallback files.
+// Pass an empty string to restore the default (.mledger in the fallback directory).
+func SetLedgerPath(path string) {
+	ledgerPathMu.Lock()
+	defer ledgerPathMu.Unlock()
+	ledgerPath = path
+}
+
+// GetLedgerPath returns the file used for the machine identity ledger.
+func GetLedgerPath() string {
+	ledgerPathMu.RLock()
+	defer ledgerPathMu.RUnlock()
+	if ledgerPath != "" {
+		return ledgerPath
+	}
+	return filepath.Join(fallbackDir, ledgerFile)
+}
+
+// ledgerEnabled reports whether generated reMachIDs are recorded: always with
+// a configured ledger path, otherwise only once the fallback directory exists.
+func ledgerEnabled() bool {
+	ledgerPathMu.RLock()
+	configured := ledgerPath != ""
+	ledgerPathMu.RUnlock()
+	if configured {
+		return true
+	}
+	fi, err := os.Lstat(fallbackDir)
+	return err == nil && fi.IsDir()
+}
+
+// ledgerFingerprint returns the keyed fingerprint of a set of identifiers.
+// The key is a random secret stored next to the ledger, so the fingerprint
+// cannot be recomputed from a known hardware serial and UUID.
+func ledgerFingerprint(serial, uuid string) (string, error) {
+	key, err := readOrCreateKeyFile(GetLedgerPath() + ledgerKeySuffix)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("machid-ledger\x00"))
+	mac.Write([]byte(serial))
+	mac.Write([]byte{0})
+	mac.Write([]byte(uuid))
+	clear(key)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// readLedgerRecords reads all records from the ledger. A missing ledger is
+// not an error. Malformed lines (e.g. a torn final write) are skipped.
+func readLedgerRecords() ([]ledgerRecord, error) {
+	f, err := os.Open(GetLedgerPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []ledgerRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record ledgerRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// appendLedgerRecord appends a record to the ledger, creating it if needed.
+func appendLedgerRecord(record ledgerRecord) error {
+	path := GetLedgerPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// recordLedger records a generated reMachID in the ledger. A record is only
+// appended when the ID is new, its sources or identifiers changed, or it has
+// not been recorded for ledgerSeenInterval.
+func recordLedger(identity *machineIdentity, remachid string) error {
+	ledgerMu.Lock()
+	defer ledgerMu.Unlock()
+
+	records, err := readLedgerRecords()
+	if err != nil {
+		return err
+	}
+	fingerprint, err := ledgerFingerprint(identity.serial, identity.uuid)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	record := ledgerRecord{
+		ReMachID:    remachid,
+		Sources:     identity.sources,
+		Time:        now,
+		Fingerprint: fingerprint,
+	}
+
+	var last, lastForID *ledgerRecord
+	knownFingerprint := false
+	for i := range records {
+		last = &records[i]
+		if records[i].ReMachID == remachid {
+			lastForID = &records[i]
+		}
+		if records[i].Fingerprint == record.Fingerprint {
+			knownFingerprint = true
+		}
+	}
+
+	switch {
+	case lastForID != nil:
+		unchanged := slices.Equal(lastForID.Sources, record.Sources) && lastForID.Fingerprint == record.Fingerprint
+		if unchanged && now.Sub(lastForID.Time) < ledgerSeenInterval {
+			return nil
+		}
+		record.Reason = LedgerReasonSeen
+		if !unchanged {
+			record.Reason = LedgerReasonSourcesChanged
+		}
+	case last == nil:
+		record.Reason = LedgerReasonFirstSeen
+	case identity.migrating:
+		record.Reason = LedgerReasonMigration
+	case knownFingerprint:
+		record.Reason = LedgerReasonNewSalt
+	case !slices.Equal(last.Sources, record.Sources):
+		record.Reason = LedgerReasonSourcesChanged
+	default:
+		record.Reason = LedgerReasonIdentifiersChanged
+	}
+
+	return appendLedgerRecord(record)
+}
+
+// ReadLedger returns one entry per reMachID recorded in the ledger, in the
+// order they first appeared. Reading the default ledger requires root privileges.
+func ReadLedger() ([]LedgerEntry, error) {
+	ledgerMu.Lock()
+	records, err := readLedgerRecords()
+	ledgerMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ledger: %w", err)
+	}
+
+	var entries []LedgerEntry
+	index := make(map[string]int)
+	for _, record := range records {
+		i, ok := index[record.ReMachID]
+		if !ok {
+			index[record.ReMachID] = len(entries)
+			entries = append(entries, LedgerEntry{
+				ReMachID:  record.ReMachID,
+				Sources:   record.Sources,
+				FirstSeen: record.Time,
+				LastSeen:  record.Time,
+				Reason:    record.Reason,
+			})
+			continue
+		}
+		entries[i].Sources = record.Sources
+		if record.Time.After(entries[i].LastSeen) {
+			entries[i].LastSeen = record.Time
+		}
+	}
+	return entries, nil
+}
+
+// WasThisMachine reports whether the given reMachID was ever produced by this
+// host according to the ledger, and returns its ledger entry if so.
+//
+// This answers questions like "does this customer's old license ID belong to
+// their current hardware after a motherboard swap?".
+func WasThisMachine(remachid string) (bool, *LedgerEntry, error) {
+	entries, err := ReadLedger()
+	if err != nil {
+		return false, nil, err
+	}
+	for i := range entries {
+		if entries[i].ReMachID == remachid {
+			return true, &entries[i], nil
+		}
+	}
+	return false, nil, nil
+}
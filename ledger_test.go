@@ -0,0 +1,183 @@
+package machid
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMain keeps the tests from recording reMachIDs in the host's ledger.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "machid-ledger-")
+	if err != nil {
+		panic(err)
+	}
+	SetLedgerPath(filepath.Join(dir, "ledger"))
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func useTempLedger(t *testing.T) {
+	t.Helper()
+	old := GetLedgerPath()
+	SetLedgerPath(filepath.Join(t.TempDir(), "ledger"))
+	t.Cleanup(func() { SetLedgerPath(old) })
+}
+
+func TestRecordLedger_Reasons(t *testing.T) {
+	useTempLedger(t)
+
+	hw := &machineIdentity{serial: "serial-a", uuid: "uuid-a", sources: []string{"sysfs:product_serial", "sysfs:product_uuid"}}
+	if err := recordLedger(hw, "id-1"); err != nil {
+		t.Fatalf("recordLedger() failed: %v", err)
+	}
+	// Same ID again within the seen interval should not add a record
+	if err := recordLedger(hw, "id-1"); err != nil {
+		t.Fatalf("recordLedger() failed: %v", err)
+	}
+	// Same identifiers, different salt
+	if err := recordLedger(hw, "id-2"); err != nil {
+		t.Fatalf("recordLedger() failed: %v", err)
+	}
+	// Motherboard swap: same sources, different values
+	swapped := &machineIdentity{serial: "serial-b", uuid: "uuid-b", sources: hw.sources}
+	if err := recordLedger(swapped, "id-3"); err != nil {
+		t.Fatalf("recordLedger() failed: %v", err)
+	}
+
+	entries, err := ReadLedger()
+	if err != nil {
+		t.Fatalf("ReadLedger() failed: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("ReadLedger() expected 3 entries, got %d: %+v", len(entries), entries)
+	}
+
+	want := []string{LedgerReasonFirstSeen, LedgerReasonNewSalt, LedgerReasonIdentifiersChanged}
+	for i, entry := range entries {
+		if entry.Reason != want[i] {
+			t.Errorf("entry %d (%s) reason = %q, expected %q", i, entry.ReMachID, entry.Reason, want[i])
+		}
+	}
+}
+
+func TestRecordLedger_SourcesChanged(t *testing.T) {
+	useTempLedger(t)
+
+	identity := &machineIdentity{serial: "s", uuid: "u", sources: []string{"sysfs:product_serial", "sysfs:product_uuid"}}
+	if err := recordLedger(identity, "id-1"); err != nil {
+		t.Fatalf("recordLedger() failed: %v", err)
+	}
+	// Same ID within the seen interval, but read through dmidecode now
+	moved := &machineIdentity{serial: "s", uuid: "u", sources: []string{"dmidecode:system-serial-number", "dmidecode:system-uuid"}}
+	if err := recordLedger(moved, "id-1"); err != nil {
+		t.Fatalf("recordLedger() failed: %v", err)
+	}
+
+	records, err := readLedgerRecords()
+	if err != nil {
+		t.Fatalf("readLedgerRecords() failed: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 ledger records, got %d", len(records))
+	}
+	if records[1].Reason != LedgerReasonSourcesChanged {
+		t.Errorf("second record reason = %q, expected %q", records[1].Reason, LedgerReasonSourcesChanged)
+	}
+}
+
+func TestLedgerFingerprint_Keyed(t *testing.T) {
+	useTempLedger(t)
+
+	fingerprint, err := ledgerFingerprint("s", "u")
+	if err != nil {
+		t.Fatalf("ledgerFingerprint() failed: %v", err)
+	}
+	if again, _ := ledgerFingerprint("s", "u"); again != fingerprint {
+		t.Error("ledgerFingerprint() should be stable for the same ledger")
+	}
+	if fingerprint == hashData("machid-ledger", "s", "u") {
+		t.Error("ledgerFingerprint() should not be an unkeyed hash of the identifiers")
+	}
+
+	// A different ledger has a different key
+	useTempLedger(t)
+	if other, _ := ledgerFingerprint("s", "u"); other == fingerprint {
+		t.Error("ledgerFingerprint() should differ between ledger keys")
+	}
+}
+
+func TestLedgerEnabled(t *testing.T) {
+	old := GetLedgerPath()
+	SetLedgerPath("")
+	defer SetLedgerPath(old)
+
+	dir := useTempFallbackDir(t)
+	if ledgerEnabled() {
+		t.Error("ledgerEnabled() should be false without a fallback directory")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if !ledgerEnabled() {
+		t.Error("ledgerEnabled() should be true once the fallback directory exists")
+	}
+
+	useTempLedger(t)
+	os.Remove(dir)
+	if !ledgerEnabled() {
+		t.Error("ledgerEnabled() should be true with a configured ledger path")
+	}
+}
+
+func TestRecordLedger_LastSeen(t *testing.T) {
+	useTempLedger(t)
+
+	old := ledgerSeenInterval
+	ledgerSeenInterval = 0
+	defer func() { ledgerSeenInterval = old }()
+
+	identity := &machineIdentity{serial: "s", uuid: "u", sources: []string{"sysfs:product_uuid"}}
+	if err := recordLedger(identity, "id-1"); err != nil {
+		t.Fatalf("recordLedger() failed: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := recordLedger(identity, "id-1"); err != nil {
+		t.Fatalf("recordLedger() failed: %v", err)
+	}
+
+	entries, err := ReadLedger()
+	if err != nil {
+		t.Fatalf("ReadLedger() failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("ReadLedger() expected 1 entry, got %d", len(entries))
+	}
+	if !entries[0].LastSeen.After(entries[0].FirstSeen) {
+		t.Errorf("LastSeen (%v) should be after FirstSeen (%v)", entries[0].LastSeen, entries[0].FirstSeen)
+	}
+}
+
+func TestWasThisMachine(t *testing.T) {
+	useTempLedger(t)
+
+	found, _, err := WasThisMachine("id-1")
+	if err != nil {
+		t.Fatalf("WasThisMachine() on empty ledger failed: %v", err)
+	}
+	if found {
+		t.Error("WasThisMachine() found an ID in an empty ledger")
+	}
+
+	identity := &machineIdentity{serial: "s", uuid: "u"}
+	if err := recordLedger(identity, "id-1"); err != nil {
+		t.Fatalf("recordLedger() failed: %v", err)
+	}
+
+	found, entry, err := WasThisMachine("id-1")
+	if err != nil || !found || entry == nil || entry.ReMachID != "id-1" {
+		t.Errorf("WasThisMachine() = %v, %+v, %v; expected a match", found, entry, err)
+	}
+}
@@ -8,7 +8,6 @@ import (
 "crypto/rand"
 "crypto/sha256"
 "encoding/hex"
-"encoding/json"
 "errors"
 "fmt"
 "io"
@@ -17,6 +16,7 @@ import (
 "path/filepath"
 "strings"
 "sync"
+"sync/atomic"
 "time"
 )
 
@@ -39,6 +39,9 @@ var (
 
 	// ErrFallbackFileCreation is returned when fallback files cannot be created
 	ErrFallbackFileCreation = errors.New("machid: failed to create filesystem fallback files")
+
+	// ErrNoWriteMode is returned when an operation would write to disk while no-write mode is enabled
+	ErrNoWriteMode = errors.New("machid: no-write mode enabled - refusing to write to disk")
 )
 
 // Configuration
@@ -47,6 +50,10 @@ var (
 	strictMode   bool
 	strictModeMu sync.RWMutex
 
+	// noWriteMode when true, guarantees the library never writes to disk
+	noWriteMode   bool
+	noWriteModeMu sync.RWMutex
+
 	// Logger function for warnings (defaults to fmt.Println to stdout)
 	// Can be overridden by SetLogger
 	loggerFunc   func(msg string)
@@ -101,6 +108,38 @@ func IsStrictMode() bool {
 	return strictMode
 }
 
+// SetNoWriteMode enables or disables no-write mode.
+// When no-write mode is enabled, the library never creates, modifies, removes or
+// chowns files:
+//   - The cache used by the GetOrGenerate* functions, RotateEMachID and
+//     IncrementActionCount is kept in process memory instead of cache.json
+//   - Existing fallback files are read, but missing ones are not created
+//   - The machine identity ledger is not updated
+//   - Explicit write operations (ClearFallbackFiles, ImportFallback) return ErrNoWriteMode
+//
+// Parameters:
+//   - enabled: true to enable no-write mode, false to allow writes
+func SetNoWriteMode(enabled bool) {
+	noWriteModeMu.Lock()
+	defer noWriteModeMu.Unlock()
+	noWriteMode = enabled
+}
+
+// IsNoWriteMode returns whether no-write mode is currently enabled.
+func IsNoWriteMode() bool {
+	noWriteModeMu.RLock()
+	defer noWriteModeMu.RUnlock()
+	return noWriteMode
+}
+
+// checkWritable returns ErrNoWriteMode if no-write mode is enabled.
+func checkWritable() error {
+	if IsNoWriteMode() {
+		return ErrNoWriteMode
+	}
+	return nil
+}
+
 // SetLogger sets a custom logger function for warning messages.
 // This is useful for integrating with existing logging frameworks.
 //
@@ -178,9 +217,95 @@ func generateRandomHex(length int) (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
+// writeFileAtomic writes data to a temporary file in the same directory and
+// renames it over path, so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // No-op after a successful rename
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// readOrCreateKeyFile reads a hex-encoded root-only secret key, creating it
+// with random data (and its directory) if it does not exist yet. In no-write
+// mode a missing key is not created and ErrNoWriteMode is returned.
+func readOrCreateKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, decodeErr := hex.DecodeString(strings.TrimSpace(string(data)))
+		if decodeErr != nil || len(key) < 32 {
+			return nil, fmt.Errorf("machid: invalid key file %s", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := checkWritable(); err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write([]byte(hex.EncodeToString(key)))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Link instead of rename so a key created concurrently by another
+	// process is never replaced
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if os.IsExist(err) {
+			return readOrCreateKeyFile(path)
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
 // ensureFallbackFiles creates the fallback directory and files if they don't exist.
 // Returns the serial and uuid values from the files.
 func ensureFallbackFiles() (serial, uuid string, err error) {
+	// In no-write mode only existing fallback files can be used
+	if IsNoWriteMode() {
+		if serial, uuid, ok := readFallbackFiles(); ok {
+			return serial, uuid, nil
+		}
+		return "", "", fmt.Errorf("%w: %w", ErrFallbackFileCreation, ErrNoWriteMode)
+	}
+
 	// Create hidden directory with restrictive permissions
 	if err := os.MkdirAll(fallbackDir, 0700); err != nil {
 		return "", "", fmt.Errorf("%w: %v", ErrFallbackFileCreation, err)
@@ -229,60 +354,124 @@ func readOrCreateFallbackFile(path string) (string, error) {
 	return randomData, nil
 }
 
-// getHardwareIdentifiers attempts to retrieve hardware identifiers from sysfs,
-// falling back to dmidecode if necessary.
-// Returns (serial, uuid, usedFallback, error)
-func getHardwareIdentifiers() (serial, uuid string, usedFallback bool, err error) {
-	// Try sysfs first for product serial
-	serial = readSysfsFile(sysfsPaths.productSerial)
-	if serial == "" {
-		serial = readSysfsFile(sysfsPaths.chassisSerial)
+// fallbackSources returns the source names recorded for fallback identifiers.
+func fallbackSources() []string {
+	return []string{
+		"fallback:" + filepath.Join(fallbackDir, fallbackSerialFile),
+		"fallback:" + filepath.Join(fallbackDir, fallbackUUIDFile),
 	}
-	if serial == "" {
-		serial = readSysfsFile(sysfsPaths.boardSerial)
+}
+
+// readFallbackFiles reads the existing fallback files without creating them.
+// ok is false if either file is missing or empty.
+func readFallbackFiles() (serial, uuid string, ok bool) {
+	serialData, err := os.ReadFile(filepath.Join(fallbackDir, fallbackSerialFile))
+	if err != nil {
+		return "", "", false
+	}
+	uuidData, err := os.ReadFile(filepath.Join(fallbackDir, fallbackUUIDFile))
+	if err != nil {
+		return "", "", false
+	}
+
+	serial = strings.TrimSpace(string(serialData))
+	uuid = strings.TrimSpace(string(uuidData))
+	if serial == "" || uuid == "" {
+		return "", "", false
+	}
+	return serial, uuid, true
+}
+
+// machineIdentity holds the identifiers a reMachID is derived from.
+type machineIdentity struct {
+	serial       string
+	uuid         string
+	usedFallback bool
+	sources      []string // Where serial and uuid were read from
+
+	// migrating is true when the host has filesystem fallback files but the
+	// firmware now reports hardware identifiers. aliasSerial and aliasUUID
+	// then hold the identifier set that was NOT selected by the migration
+	// policy, so the alternative reMachID can be reported.
+	migrating   bool
+	aliasSerial string
+	aliasUUID   string
+}
+
+// clear wipes the identifiers held by the identity (best effort).
+func (m *machineIdentity) clear() {
+	clearString(&m.serial)
+	clearString(&m.uuid)
+	clearString(&m.aliasSerial)
+	clearString(&m.aliasUUID)
+}
+
+// readHardwareIdentifiers attempts to retrieve hardware identifiers from sysfs,
+// falling back to dmidecode if necessary. Empty values mean the identifier is
+// not available. sources names where each returned identifier came from.
+func readHardwareIdentifiers() (serial, uuid string, sources []string, err error) {
+	// Try sysfs first for product serial
+	for _, path := range []string{sysfsPaths.productSerial, sysfsPaths.chassisSerial, sysfsPaths.boardSerial} {
+		if serial = readSysfsFile(path); serial != "" {
+			sources = append(sources, "sysfs:"+filepath.Base(path))
+			break
+		}
 	}
 
 	// Try sysfs for product UUID
-	uuid = readSysfsFile(sysfsPaths.productUUID)
+	if uuid = readSysfsFile(sysfsPaths.productUUID); uuid != "" {
+		sources = append(sources, "sysfs:"+filepath.Base(sysfsPaths.productUUID))
+	}
 
 	// If we have both, return them
 	if serial != "" && uuid != "" {
-		return serial, uuid, false, nil
+		return serial, uuid, sources, nil
 	}
 
 	// Try dmidecode as fallback
-	var dmidecodeErr error
-
 	if serial == "" {
-		serial, dmidecodeErr = getDmidecodeValue("system-serial-number")
-		if dmidecodeErr != nil && dmidecodeErr != ErrDmidecodeNotFound {
-			return "", "", false, dmidecodeErr
-		}
-		if serial == "" {
-			serial, _ = getDmidecodeValue("chassis-serial-number")
-		}
-		if serial == "" {
-			serial, _ = getDmidecodeValue("baseboard-serial-number")
+		for i, keyword := range []string{"system-serial-number", "chassis-serial-number", "baseboard-serial-number"} {
+			value, dmidecodeErr := getDmidecodeValue(keyword)
+			if i == 0 && dmidecodeErr != nil && dmidecodeErr != ErrDmidecodeNotFound {
+				return "", "", nil, dmidecodeErr
+			}
+			if value != "" {
+				serial = value
+				sources = append(sources, "dmidecode:"+keyword)
+				break
+			}
 		}
 	}
 
 	if uuid == "" {
-		uuid, dmidecodeErr = getDmidecodeValue("system-uuid")
 		// Ignore dmidecode errors here, we'll handle missing data below
+		if uuid, _ = getDmidecodeValue("system-uuid"); uuid != "" {
+			sources = append(sources, "dmidecode:system-uuid")
+		}
+	}
+
+	return serial, uuid, sources, nil
+}
+
+// getHardwareIdentifiers returns the identifiers used to derive the reMachID.
+// Hardware identifiers are preferred; if none are available and strict mode is
+// disabled, the filesystem fallback in /etc/.machid is used. When both are
+// present and the fallback was in use for salt, the migration policy decides
+// which set is used.
+func getHardwareIdentifiers(salt string) (*machineIdentity, error) {
+	serial, uuid, sources, err := readHardwareIdentifiers()
+	if err != nil {
+		return nil, err
 	}
 
 	// Check if we got at least one identifier from hardware
 	if serial != "" || uuid != "" {
-		return serial, uuid, false, nil
+		return resolveMigration(serial, uuid, sources, salt), nil
 	}
 
 	// No hardware identifiers available - check strict mode
-	strictModeMu.RLock()
-	isStrict := strictMode
-	strictModeMu.RUnlock()
-
-	if isStrict {
-		return "", "", false, ErrStrictModeNoHardwareID
+	if IsStrictMode() {
+		return nil, ErrStrictModeNoHardwareID
 	}
 
 	// Log warning about using filesystem fallback
@@ -293,10 +482,10 @@ func getHardwareIdentifiers() (serial, uuid string, usedFallback bool, err error
 	// Use filesystem fallback
 	serial, uuid, err = ensureFallbackFiles()
 	if err != nil {
-		return "", "", false, err
+		return nil, err
 	}
 
-	return serial, uuid, true, nil
+	return &machineIdentity{serial: serial, uuid: uuid, usedFallback: true, sources: fallbackSources()}, nil
 }
 
 // hashData creates a SHA-256 hash of the input data and returns it as a hex string.
@@ -327,33 +516,47 @@ func clearString(s *string) {
 	*s = ""
 }
 
+// emachidCounter is mixed into every eMachID so IDs generated by this process
+// within the same clock tick never collide
+var emachidCounter atomic.Uint64
+
 // GenerateEMachID generates an Ephemeral Machine Identifier.
-// This ID is unique and can only be generated once (based on current Unix nanosecond time and salt).
+// This ID is unique and can only be generated once (based on current Unix nanosecond time,
+// 128 bits of crypto/rand entropy, a per-process counter and the salt).
 // 
 // Unlike GenerateReMachID, this function does NOT require root privileges since
-// it only uses the current timestamp and salt, not hardware identifiers.
+// it only uses the current timestamp, random data and salt, not hardware identifiers.
 //
 // Parameters:
 //   - salt: A non-empty string used to add entropy to the hash
 //
 // Returns:
 //   - The eMachID as a hex-encoded SHA-256 hash
-//   - An error if salt is empty
+//   - An error if salt is empty or the system random source fails
 //
-// Security: The salt and time values are cleared from memory after hashing.
+// Security: The random nonce makes eMachIDs unguessable even if the salt and the
+// approximate generation time are known. The salt and time values are cleared
+// from memory after hashing.
 func GenerateEMachID(salt string) (string, error) {
 if salt == "" {
 return "", ErrEmptySalt
 }
 
-// Get current time in nanoseconds for maximum uniqueness
-timestamp := fmt.Sprintf("%d", time.Now().UnixNano())
+// Random nonce so the ID cannot be brute-forced from the salt and timestamp
+nonce, err := generateRandomHex(16)
+if err != nil {
+return "", fmt.Errorf("machid: failed to read random data: %w", err)
+}
+
+// Current time in nanoseconds plus a counter unique within this process
+input := fmt.Sprintf("%d:%d:%s", time.Now().UnixNano(), emachidCounter.Add(1), nonce)
 
 // Create the hash
-emachid := hashData(timestamp, salt)
+emachid := hashData(input, salt)
 
-// Clear the salt copy (the original is the caller's responsibility)
-clearString(&timestamp)
+// Clear the input copies (the original salt is the caller's responsibility)
+clearString(&input)
+clearString(&nonce)
 
 return emachid, nil
 }
@@ -380,29 +583,11 @@ return emachid, nil
 //
 // Note: If filesystem fallback is used, a warning will be logged to stdout.
 // Use SetStrictMode(true) to disable the filesystem fallback.
+// If the firmware starts reporting hardware identifiers on a host that has been
+// using the fallback, the MigrationPolicy decides which ID is returned.
 func GenerateReMachID(salt string) (string, error) {
-	if err := checkRoot(); err != nil {
-		return "", err
-	}
-
-	serial, uuid, _, err := getHardwareIdentifiers()
-	if err != nil {
-		return "", err
-	}
-
-	// Create the hash with serial, uuid, and optional salt
-	var remachid string
-	if salt != "" {
-		remachid = hashData(serial, uuid, salt)
-	} else {
-		remachid = hashData(serial, uuid)
-	}
-
-	// Clear sensitive data
-	clearString(&serial)
-	clearString(&uuid)
-
-	return remachid, nil
+	remachid, _, err := GenerateReMachIDWithInfo(salt)
+	return remachid, err
 }
 
 // GenerateReMachIDWithInfo generates a Reconstructable Machine Identifier and returns
@@ -419,27 +604,61 @@ func GenerateReMachID(salt string) (string, error) {
 //   - usedFallback: true if filesystem fallback was used instead of hardware IDs
 //   - An error if generation fails
 func GenerateReMachIDWithInfo(salt string) (remachid string, usedFallback bool, err error) {
-	if err := checkRoot(); err != nil {
-		return "", false, err
-	}
-
-	serial, uuid, usedFallback, err := getHardwareIdentifiers()
+	result, err := generateReMachID(salt)
 	if err != nil {
 		return "", false, err
 	}
+	return result.remachid, result.usedFallback, nil
+}
 
-	// Create the hash with serial, uuid, and optional salt
+// reMachIDResult is the outcome of a reMachID generation.
+type reMachIDResult struct {
+	remachid     string
+	usedFallback bool
+	// aliasID is the reMachID derived from the identifier set that was not
+	// selected during a fallback-to-hardware migration (empty otherwise).
+	aliasID string
+}
+
+// deriveReMachID hashes the identifiers with the optional salt.
+func deriveReMachID(serial, uuid, salt string) string {
 	if salt != "" {
-		remachid = hashData(serial, uuid, salt)
-	} else {
-		remachid = hashData(serial, uuid)
+		return hashData(serial, uuid, salt)
+	}
+	return hashData(serial, uuid)
+}
+
+// generateReMachID is the shared implementation behind the GenerateReMachID
+// family. It requires root privileges.
+func generateReMachID(salt string) (*reMachIDResult, error) {
+	if err := checkRoot(); err != nil {
+		return nil, err
 	}
 
+	identity, err := getHardwareIdentifiers(salt)
+	if err != nil {
+		return nil, err
+	}
 	// Clear sensitive data
-	clearString(&serial)
-	clearString(&uuid)
+	defer identity.clear()
+
+	result := &reMachIDResult{
+		remachid:     deriveReMachID(identity.serial, identity.uuid, salt),
+		usedFallback: identity.usedFallback,
+	}
+
+	if identity.migrating {
+		result.aliasID = deriveReMachID(identity.aliasSerial, identity.aliasUUID, salt)
+		notifyMigration(result)
+	}
+
+	if !IsNoWriteMode() && ledgerEnabled() {
+		if err := recordLedger(identity, result.remachid); err != nil {
+			logWarning(fmt.Sprintf("WARNING: machid - Failed to update machine identity ledger: %v", err))
+		}
+	}
 
-	return remachid, usedFallback, nil
+	return result, nil
 }
 
 // MachIDInfo contains both types of machine identifiers.
@@ -447,6 +666,8 @@ type MachIDInfo struct {
 	EMachID      string // Ephemeral Machine Identifier
 	ReMachID     string // Reconstructable Machine Identifier
 	UsedFallback bool   // True if filesystem fallback was used for reMachID
+	AliasID      string // Alternative reMachID during a fallback-to-hardware migration (see MigrationPolicy)
+	BootMachID   string // Per-boot identifier (empty if the boot ID is unavailable, see GenerateBootMachID)
 }
 
 // GenerateBoth generates both eMachID and reMachID in a single call.
@@ -463,15 +684,20 @@ func GenerateBoth(salt string) (*MachIDInfo, error) {
 		return nil, fmt.Errorf("failed to generate eMachID: %w", err)
 	}
 
-	remachid, usedFallback, err := GenerateReMachIDWithInfo(salt)
+	result, err := generateReMachID(salt)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate reMachID: %w", err)
 	}
 
+	// The boot ID is not available on every system, so it is optional here
+	bootMachID, _ := GenerateBootMachID(salt)
+
 	return &MachIDInfo{
 		EMachID:      emachid,
-		ReMachID:     remachid,
-		UsedFallback: usedFallback,
+		ReMachID:     result.remachid,
+		UsedFallback: result.usedFallback,
+		AliasID:      result.aliasID,
+		BootMachID:   bootMachID,
 	}, nil
 }
 
@@ -483,6 +709,9 @@ func ClearFallbackFiles() error {
 	if err := checkRoot(); err != nil {
 		return err
 	}
+	if err := checkWritable(); err != nil {
+		return err
+	}
 
 	serialPath := filepath.Join(fallbackDir, fallbackSerialFile)
 	uuidPath := filepath.Join(fallbackDir, fallbackUUIDFile)
@@ -513,302 +742,3 @@ _, uuidErr := os.Stat(uuidPath)
 
 return serialErr == nil && uuidErr == nil
 }
-
-// ================================================================================
-// Caching API
-// ================================================================================
-//
-// The caching system allows applications to cache machine IDs to avoid requiring
-// sudo on every run. The first run with sudo generates and caches the IDs, and
-// subsequent runs can use the cached values without elevated privileges.
-
-// CachedMachineIDs holds cached machine identifiers
-type CachedMachineIDs struct {
-ReMachID    string `json:"remach_id"`
-EMachID     string `json:"emach_id,omitempty"`
-Salt        string `json:"salt,omitempty"`
-ActionCount int    `json:"action_count"`
-CreatedAt   int64  `json:"created_at,omitempty"`
-}
-
-// Default cache directory (user-specific)
-var (
-cacheSubDir  = ".config/machid"
-cacheFile    = "cache.json"
-)
-
-// getCacheDir returns the appropriate cache directory based on sudo status
-func getCacheDir() string {
-var home string
-
-// Check if running with sudo - use the real user's home
-if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
-home = filepath.Join("/home", sudoUser)
-if _, err := os.Stat(home); err != nil {
-// Fallback to /tmp
-return filepath.Join("/tmp", cacheSubDir)
-}
-} else {
-var err error
-home, err = os.UserHomeDir()
-if err != nil {
-return filepath.Join("/tmp", cacheSubDir)
-}
-}
-
-return filepath.Join(home, cacheSubDir)
-}
-
-// getCachePath returns the full path to the cache file
-func getCachePath() string {
-return filepath.Join(getCacheDir(), cacheFile)
-}
-
-// LoadCachedIDs loads cached machine IDs from disk.
-// Returns nil if no cache exists or cache is invalid.
-func LoadCachedIDs() (*CachedMachineIDs, error) {
-data, err := os.ReadFile(getCachePath())
-if err != nil {
-return nil, err
-}
-
-var cache CachedMachineIDs
-if err := json.Unmarshal(data, &cache); err != nil {
-return nil, err
-}
-
-return &cache, nil
-}
-
-// SaveCachedIDs saves machine IDs to the cache file.
-// When running with sudo, it fixes ownership so the real user can read the file.
-func SaveCachedIDs(cache *CachedMachineIDs) error {
-cacheDir := getCacheDir()
-if err := os.MkdirAll(cacheDir, 0755); err != nil {
-return err
-}
-
-data, err := json.MarshalIndent(cache, "", "  ")
-if err != nil {
-return err
-}
-
-cachePath := getCachePath()
-if err := os.WriteFile(cachePath, data, 0644); err != nil {
-return err
-}
-
-// If running with sudo, fix ownership so the real user can read it
-if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
-if uidStr := os.Getenv("SUDO_UID"); uidStr != "" {
-if gidStr := os.Getenv("SUDO_GID"); gidStr != "" {
-var uid, gid int
-fmt.Sscanf(uidStr, "%d", &uid)
-fmt.Sscanf(gidStr, "%d", &gid)
-os.Chown(cacheDir, uid, gid)
-os.Chown(cachePath, uid, gid)
-}
-}
-}
-
-return nil
-}
-
-// ClearCache removes the cached machine IDs.
-func ClearCache() error {
-cachePath := getCachePath()
-if err := os.Remove(cachePath); err != nil && !os.IsNotExist(err) {
-return err
-}
-return nil
-}
-
-// GetOrGenerateReMachID attempts to load the cached reMachID, or generates a new one.
-// If generation is needed, sudo is required. The generated ID is cached for future use.
-//
-// Parameters:
-//   - salt: Salt for the machine ID (must match previous runs for consistent IDs)
-//
-// Returns:
-//   - The reMachID
-//   - Whether the ID was loaded from cache (true) or freshly generated (false)
-//   - An error if generation fails (including if sudo is required but not available)
-func GetOrGenerateReMachID(salt string) (remachid string, fromCache bool, err error) {
-// Try loading from cache first
-cache, err := LoadCachedIDs()
-if err == nil && cache.ReMachID != "" {
-// Verify salt matches if provided in cache
-if cache.Salt == "" || cache.Salt == salt {
-return cache.ReMachID, true, nil
-}
-// Salt mismatch - need to regenerate
-logWarning("WARNING: machid - Salt mismatch in cache, regenerating reMachID")
-}
-
-// Need to generate - this requires sudo
-remachid, err = GenerateReMachID(salt)
-if err != nil {
-return "", false, err
-}
-
-// Save to cache
-newCache := &CachedMachineIDs{
-ReMachID:  remachid,
-Salt:      salt,
-CreatedAt: time.Now().Unix(),
-}
-
-// Try to preserve existing eMachID if present
-if cache != nil && cache.EMachID != "" {
-newCache.EMachID = cache.EMachID
-newCache.ActionCount = cache.ActionCount
-}
-
-if saveErr := SaveCachedIDs(newCache); saveErr != nil {
-logWarning(fmt.Sprintf("WARNING: machid - Failed to cache reMachID: %v", saveErr))
-}
-
-return remachid, false, nil
-}
-
-// GetOrGenerateEMachID attempts to load the cached eMachID, or generates a new one.
-// This function does NOT require sudo since eMachID generation uses timestamps only.
-//
-// Parameters:
-//   - salt: Salt for the machine ID
-//
-// Returns:
-//   - The eMachID
-//   - Whether the ID was loaded from cache (true) or freshly generated (false)
-//   - An error if generation fails
-func GetOrGenerateEMachID(salt string) (emachid string, fromCache bool, err error) {
-// Try loading from cache first
-cache, err := LoadCachedIDs()
-if err == nil && cache.EMachID != "" {
-return cache.EMachID, true, nil
-}
-
-// Generate new eMachID (no sudo required)
-emachid, err = GenerateEMachID(salt)
-if err != nil {
-return "", false, err
-}
-
-// Save to cache (or update existing cache with eMachID)
-var newCache *CachedMachineIDs
-if cache != nil {
-newCache = cache
-newCache.EMachID = emachid
-} else {
-newCache = &CachedMachineIDs{
-EMachID:   emachid,
-Salt:      salt,
-CreatedAt: time.Now().Unix(),
-}
-}
-
-if saveErr := SaveCachedIDs(newCache); saveErr != nil {
-logWarning(fmt.Sprintf("WARNING: machid - Failed to cache eMachID: %v", saveErr))
-}
-
-return emachid, false, nil
-}
-
-// GetOrGenerateBoth loads or generates both machine IDs.
-// For reMachID, sudo is required if not cached.
-// For eMachID, sudo is never required.
-//
-// Parameters:
-//   - salt: Salt for both machine IDs
-//
-// Returns:
-//   - CachedMachineIDs containing both IDs
-//   - An error if reMachID generation fails (typically if sudo is needed but not available)
-func GetOrGenerateBoth(salt string) (*CachedMachineIDs, error) {
-// Try to get reMachID first (may require sudo)
-remachid, reCached, err := GetOrGenerateReMachID(salt)
-if err != nil {
-return nil, fmt.Errorf("failed to get reMachID: %w", err)
-}
-
-// Get eMachID (never requires sudo)
-emachid, eCached, err := GetOrGenerateEMachID(salt)
-if err != nil {
-return nil, fmt.Errorf("failed to get eMachID: %w", err)
-}
-
-// Load full cache to get action count
-cache, _ := LoadCachedIDs()
-actionCount := 0
-if cache != nil {
-actionCount = cache.ActionCount
-}
-
-result := &CachedMachineIDs{
-ReMachID:    remachid,
-EMachID:     emachid,
-Salt:        salt,
-ActionCount: actionCount,
-}
-
-// Log caching status
-if reCached && eCached {
-logWarning("✓ Using cached machine IDs (no sudo required)")
-} else if reCached {
-logWarning("✓ Using cached reMachID, generated new eMachID")
-} else {
-logWarning("✓ Generated and cached machine IDs")
-}
-
-return result, nil
-}
-
-// RotateEMachID generates a new eMachID and updates the cache.
-// This should be called when you need to refresh the ephemeral ID.
-// Does NOT require sudo.
-//
-// Parameters:
-//   - salt: Salt for the new eMachID
-//
-// Returns:
-//   - The new eMachID
-//   - An error if generation or caching fails
-func RotateEMachID(salt string) (string, error) {
-// Generate new eMachID
-emachid, err := GenerateEMachID(salt)
-if err != nil {
-return "", err
-}
-
-// Load existing cache
-cache, _ := LoadCachedIDs()
-if cache == nil {
-cache = &CachedMachineIDs{Salt: salt}
-}
-
-// Update with new eMachID
-cache.EMachID = emachid
-cache.ActionCount = 0
-
-if err := SaveCachedIDs(cache); err != nil {
-return "", fmt.Errorf("failed to save rotated eMachID: %w", err)
-}
-
-return emachid, nil
-}
-
-// IncrementActionCount increments the action counter in the cache.
-// Returns the new action count.
-func IncrementActionCount() (int, error) {
-cache, err := LoadCachedIDs()
-if err != nil {
-return 0, err
-}
-
-cache.ActionCount++
-if err := SaveCachedIDs(cache); err != nil {
-return 0, err
-}
-
-return cache.ActionCount, nil
-}
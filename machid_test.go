@@ -1,8 +1,11 @@
 package machid
 
 import (
+"errors"
 "os"
+"path/filepath"
 "strings"
+"sync"
 "testing"
 )
 
@@ -358,3 +361,85 @@ t.Errorf("Warning message doesn't contain 'WARNING': %s", w)
 t.Logf("Logged %d warnings", len(warnings))
 }
 }
+
+func TestNoWriteMode_FallbackNotCreated(t *testing.T) {
+	dir := useTempFallbackDir(t)
+
+	SetNoWriteMode(true)
+	defer SetNoWriteMode(false)
+
+	if _, _, err := ensureFallbackFiles(); !errors.Is(err, ErrNoWriteMode) {
+		t.Errorf("ensureFallbackFiles() in no-write mode expected ErrNoWriteMode, got: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("ensureFallbackFiles() created %s in no-write mode", dir)
+	}
+
+	// Existing fallback files can still be read
+	writeFallbackFiles(t, dir, "serial", "uuid")
+	serial, uuid, err := ensureFallbackFiles()
+	if err != nil || serial != "serial" || uuid != "uuid" {
+		t.Errorf("ensureFallbackFiles() = %q, %q, %v; expected existing values", serial, uuid, err)
+	}
+}
+
+func TestNoWriteMode_CacheInMemory(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SUDO_USER", "")
+
+	SetNoWriteMode(true)
+	defer SetNoWriteMode(false)
+	defer ClearCache()
+
+	emachid, fromCache, err := GetOrGenerateEMachID("test-salt")
+	if err != nil || fromCache {
+		t.Fatalf("GetOrGenerateEMachID() = %q, %v, %v", emachid, fromCache, err)
+	}
+	if count, err := IncrementActionCount(); err != nil || count != 1 {
+		t.Errorf("IncrementActionCount() = %d, %v; expected 1", count, err)
+	}
+
+	cached, fromCache, err := GetOrGenerateEMachID("test-salt")
+	if err != nil || !fromCache || cached != emachid {
+		t.Errorf("GetOrGenerateEMachID() did not return the in-memory cached ID: %q, %v, %v", cached, fromCache, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(home, cacheSubDir)); !os.IsNotExist(err) {
+		t.Errorf("cache directory was created in no-write mode")
+	}
+}
+
+func TestGenerateEMachID_ConcurrentUnique(t *testing.T) {
+	const goroutines, perGoroutine = 64, 500
+
+	ids := make(chan string, goroutines*perGoroutine)
+	var wg sync.WaitGroup
+	for range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perGoroutine {
+				id, err := GenerateEMachID("test-salt")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ids <- id
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[string]bool, goroutines*perGoroutine)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("GenerateEMachID() produced duplicate ID %s under concurrency", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != goroutines*perGoroutine {
+		t.Errorf("expected %d IDs, got %d", goroutines*perGoroutine, len(seen))
+	}
+}
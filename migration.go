@@ -0,0 +1,201 @@
+package machid
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MigrationPolicy controls which identifiers are used when a host that has been
+// using the filesystem fallback starts reporting hardware identifiers, e.g.
+// after a BIOS update populates product_serial/product_uuid.
+//
+// The fallback counts as in use if the ledger, or else the system or per-user
+// cache, last recorded the reMachID derived from the fallback files. Fallback
+// files that were never used (e.g. left over while the firmware already
+// reported hardware identifiers) do not start a migration.
+type MigrationPolicy int
+
+const (
+	// MigrationPinFallback keeps deriving the reMachID from the fallback files
+	// in /etc/.machid, so the ID does not change. This is the default.
+	MigrationPinFallback MigrationPolicy = iota
+
+	// MigrationAdoptHardware switches to the hardware identifiers. The fallback
+	// files are kept so the previous reMachID remains available as an alias
+	// until ClearFallbackFiles is called.
+	MigrationAdoptHardware
+)
+
+// String returns a human-readable name for the policy.
+func (p MigrationPolicy) String() string {
+	switch p {
+	case MigrationPinFallback:
+		return "pin-fallback"
+	case MigrationAdoptHardware:
+		return "adopt-hardware"
+	default:
+		return fmt.Sprintf("MigrationPolicy(%d)", int(p))
+	}
+}
+
+// MigrationEvent describes a detected fallback-to-hardware transition.
+type MigrationEvent struct {
+	OldID   string          // reMachID derived from the filesystem fallback files
+	NewID   string          // reMachID derived from the hardware identifiers
+	Reason  string          // Why the migration was detected
+	Policy  MigrationPolicy // Policy in effect when the event was raised
+	Adopted bool            // True if NewID is the ID returned to the caller
+}
+
+// Migration reasons
+const (
+	// MigrationReasonHardwareAvailable is reported when the firmware reports
+	// hardware identifiers while fallback files exist.
+	MigrationReasonHardwareAvailable = "hardware identifiers became available while filesystem fallback files exist"
+)
+
+var (
+	migrationPolicy   = MigrationPinFallback
+	migrationPolicyMu sync.RWMutex
+
+	migrationHandler   func(MigrationEvent)
+	migrationHandlerMu sync.RWMutex
+
+	// migrationNotified holds the events already reported by this process
+	migrationNotified   = make(map[MigrationEvent]bool)
+	migrationNotifiedMu sync.Mutex
+)
+
+// SetMigrationPolicy sets how the library behaves when hardware identifiers
+// appear on a host that has been using the filesystem fallback.
+//
+// Strict mode always uses the hardware identifiers, regardless of the policy.
+//
+// Parameters:
+//   - policy: MigrationPinFallback (default) or MigrationAdoptHardware
+func SetMigrationPolicy(policy MigrationPolicy) {
+	migrationPolicyMu.Lock()
+	defer migrationPolicyMu.Unlock()
+	migrationPolicy = policy
+}
+
+// GetMigrationPolicy returns the current migration policy.
+func GetMigrationPolicy() MigrationPolicy {
+	migrationPolicyMu.RLock()
+	defer migrationPolicyMu.RUnlock()
+	return migrationPolicy
+}
+
+// SetMigrationHandler sets a callback that receives a MigrationEvent when a
+// reMachID is generated on a host migrating from fallback to hardware
+// identifiers, once per process for each transition and policy outcome (pinned
+// or adopted). Once the hardware ID is adopted and recorded, the transition is
+// complete and is not reported again.
+// Pass nil to remove the handler.
+//
+// The handler is called synchronously from the generating goroutine.
+func SetMigrationHandler(handler func(MigrationEvent)) {
+	migrationHandlerMu.Lock()
+	defer migrationHandlerMu.Unlock()
+	migrationHandler = handler
+}
+
+// resolveMigration builds the machine identity for hardware identifiers,
+// taking fallback files that were in use for salt into account.
+func resolveMigration(serial, uuid string, sources []string, salt string) *machineIdentity {
+	identity := &machineIdentity{serial: serial, uuid: uuid, sources: sources}
+
+	fbSerial, fbUUID, ok := readFallbackFiles()
+	if !ok || !fallbackInUse(salt, deriveReMachID(fbSerial, fbUUID, salt), deriveReMachID(serial, uuid, salt)) {
+		return identity
+	}
+
+	identity.migrating = true
+	if GetMigrationPolicy() == MigrationPinFallback && !IsStrictMode() {
+		identity.serial, identity.uuid = fbSerial, fbUUID
+		identity.aliasSerial, identity.aliasUUID = serial, uuid
+		identity.usedFallback = true
+		identity.sources = fallbackSources()
+	} else {
+		identity.aliasSerial, identity.aliasUUID = fbSerial, fbUUID
+	}
+
+	return identity
+}
+
+// fallbackInUse reports whether the reMachID for salt last recorded by the
+// ledger, or else by the system or per-user cache, is the one derived from the
+// fallback files. Without a record the hardware identifiers are used, as they
+// were before migrations were detected.
+func fallbackInUse(salt, fallbackID, hardwareID string) bool {
+	if records, err := readLedgerRecords(); err == nil {
+		for i := len(records) - 1; i >= 0; i-- {
+			switch records[i].ReMachID {
+			case fallbackID:
+				return true
+			case hardwareID:
+				return false
+			}
+		}
+	}
+
+	entries := []*CachedMachineIDs{loadSystemEntry(salt)}
+	if doc, err := loadCacheDocument(); err == nil {
+		if name, ok := findNamespace(doc, salt, false); ok {
+			entries = append(entries, doc.Namespaces[name])
+		}
+	}
+	for _, entry := range entries {
+		if entry == nil || entry.VerifyReMachID(salt) != nil {
+			continue
+		}
+		switch entry.ReMachID {
+		case fallbackID:
+			return true
+		case hardwareID:
+			return false
+		}
+	}
+	return false
+}
+
+// notifyMigration logs the transition and invokes the migration handler, once
+// per transition and process.
+func notifyMigration(result *reMachIDResult) {
+	policy := GetMigrationPolicy()
+	adopted := !result.usedFallback
+
+	event := MigrationEvent{
+		Reason:  MigrationReasonHardwareAvailable,
+		Policy:  policy,
+		Adopted: adopted,
+	}
+	if adopted {
+		event.OldID, event.NewID = result.aliasID, result.remachid
+	} else {
+		event.OldID, event.NewID = result.remachid, result.aliasID
+	}
+
+	migrationNotifiedMu.Lock()
+	notified := migrationNotified[event]
+	migrationNotified[event] = true
+	migrationNotifiedMu.Unlock()
+	if notified {
+		return
+	}
+
+	logWarning("WARNING: machid - Hardware identifiers are now available but filesystem fallback files exist in " + fallbackDir)
+	if adopted {
+		logWarning("WARNING: machid - Using hardware identifiers; the previous fallback-based reMachID is reported as an alias.")
+	} else {
+		logWarning("WARNING: machid - Staying pinned to the fallback-based reMachID (see SetMigrationPolicy).")
+	}
+
+	migrationHandlerMu.RLock()
+	handler := migrationHandler
+	migrationHandlerMu.RUnlock()
+
+	if handler != nil {
+		handler(event)
+	}
+}
@@ -0,0 +1,154 @@
+package machid
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTempFallbackDir points the fallback directory at a temporary directory
+// for the duration of the test.
+func useTempFallbackDir(t *testing.T) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), ".machid")
+	old := fallbackDir
+	fallbackDir = dir
+	t.Cleanup(func() { fallbackDir = old })
+	return dir
+}
+
+// silenceLogger disables warning output for the duration of the test and
+// restores the previous logger afterwards.
+func silenceLogger(t *testing.T) {
+	t.Helper()
+	loggerFuncMu.RLock()
+	old := loggerFunc
+	loggerFuncMu.RUnlock()
+	SetLogger(nil)
+	t.Cleanup(func() { SetLogger(old) })
+}
+
+func writeFallbackFiles(t *testing.T, dir, serial, uuid string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, fallbackSerialFile), []byte(serial), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, fallbackUUIDFile), []byte(uuid), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveMigration_NoFallbackFiles(t *testing.T) {
+	useTempFallbackDir(t)
+
+	identity := resolveMigration("hw-serial", "hw-uuid", []string{"sysfs:product_serial"}, "test-salt")
+	if identity.migrating {
+		t.Error("resolveMigration() reported a migration without fallback files")
+	}
+	if identity.serial != "hw-serial" || identity.uuid != "hw-uuid" || identity.usedFallback {
+		t.Errorf("resolveMigration() did not use hardware identifiers: %+v", identity)
+	}
+}
+
+// useFallbackInUse records the fallback reMachID for test-salt in the cache,
+// as left by a host that was using the fallback files.
+func useFallbackInUse(t *testing.T) {
+	t.Helper()
+	useMemoryCacheStore(t)
+	useTempLedger(t)
+	if err := SaveCachedIDs(&CachedMachineIDs{ReMachID: deriveReMachID("fb-serial", "fb-uuid", "test-salt"), Salt: "test-salt"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveMigration_UnusedFallbackFiles(t *testing.T) {
+	dir := useTempFallbackDir(t)
+	writeFallbackFiles(t, dir, "fb-serial", "fb-uuid")
+	useMemoryCacheStore(t)
+	useTempLedger(t)
+
+	// Fallback files the host never used do not pin it to them
+	identity := resolveMigration("hw-serial", "hw-uuid", []string{"sysfs:product_serial"}, "test-salt")
+	if identity.migrating || identity.serial != "hw-serial" || identity.usedFallback {
+		t.Errorf("resolveMigration() without a recorded fallback ID = %+v; expected hardware identifiers", identity)
+	}
+
+	// Neither do they once the hardware ID is recorded
+	if err := SaveCachedIDs(&CachedMachineIDs{ReMachID: deriveReMachID("hw-serial", "hw-uuid", "test-salt"), Salt: "test-salt"}); err != nil {
+		t.Fatal(err)
+	}
+	identity = resolveMigration("hw-serial", "hw-uuid", []string{"sysfs:product_serial"}, "test-salt")
+	if identity.migrating || identity.serial != "hw-serial" {
+		t.Errorf("resolveMigration() with the hardware ID cached = %+v; expected hardware identifiers", identity)
+	}
+}
+
+func TestResolveMigration_PinFallback(t *testing.T) {
+	dir := useTempFallbackDir(t)
+	writeFallbackFiles(t, dir, "fb-serial", "fb-uuid")
+	useFallbackInUse(t)
+
+	SetMigrationPolicy(MigrationPinFallback)
+
+	identity := resolveMigration("hw-serial", "hw-uuid", []string{"sysfs:product_serial"}, "test-salt")
+	if !identity.migrating {
+		t.Fatal("resolveMigration() did not detect the migration")
+	}
+	if identity.serial != "fb-serial" || identity.uuid != "fb-uuid" || !identity.usedFallback {
+		t.Errorf("resolveMigration() should stay pinned to the fallback: %+v", identity)
+	}
+	if identity.aliasSerial != "hw-serial" || identity.aliasUUID != "hw-uuid" {
+		t.Errorf("resolveMigration() alias should hold hardware identifiers: %+v", identity)
+	}
+}
+
+func TestResolveMigration_AdoptHardware(t *testing.T) {
+	dir := useTempFallbackDir(t)
+	writeFallbackFiles(t, dir, "fb-serial", "fb-uuid")
+	useFallbackInUse(t)
+
+	SetMigrationPolicy(MigrationAdoptHardware)
+	defer SetMigrationPolicy(MigrationPinFallback)
+
+	identity := resolveMigration("hw-serial", "hw-uuid", []string{"sysfs:product_serial"}, "test-salt")
+	if identity.serial != "hw-serial" || identity.uuid != "hw-uuid" || identity.usedFallback {
+		t.Errorf("resolveMigration() should adopt hardware identifiers: %+v", identity)
+	}
+	if identity.aliasSerial != "fb-serial" || identity.aliasUUID != "fb-uuid" {
+		t.Errorf("resolveMigration() alias should hold fallback identifiers: %+v", identity)
+	}
+}
+
+func TestNotifyMigration(t *testing.T) {
+	silenceLogger(t)
+
+	var got []MigrationEvent
+	SetMigrationHandler(func(e MigrationEvent) { got = append(got, e) })
+	defer SetMigrationHandler(nil)
+
+	// Every generation reports the transition, but the handler sees it once
+	for range 3 {
+		notifyMigration(&reMachIDResult{remachid: "fallback-id", usedFallback: true, aliasID: "hardware-id"})
+	}
+	for range 3 {
+		notifyMigration(&reMachIDResult{remachid: "hardware-id", aliasID: "fallback-id"})
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("expected 2 migration events, got %d", len(got))
+	}
+	for i, e := range got {
+		if e.OldID != "fallback-id" || e.NewID != "hardware-id" {
+			t.Errorf("event %d has wrong IDs: %+v", i, e)
+		}
+		if e.Reason != MigrationReasonHardwareAvailable {
+			t.Errorf("event %d has wrong reason: %q", i, e.Reason)
+		}
+	}
+	if got[0].Adopted || !got[1].Adopted {
+		t.Errorf("events report wrong adoption state: %+v", got)
+	}
+}
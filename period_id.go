@@ -0,0 +1,238 @@
+package machid
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ================================================================================
+// Period IDs
+// ================================================================================
+//
+// A period ID is stable within a period (day, week or month) but changes at
+// every period boundary. It is an HMAC of the purpose and the period start
+// under a period key derived from the reMachID, so third parties cannot link
+// the IDs of different periods, while holders of the period key can.
+
+// Period ID errors
+var (
+	// ErrInvalidPeriod is returned for an unknown Period value
+	ErrInvalidPeriod = errors.New("machid: invalid period")
+
+	// ErrEmptyPurpose is returned when no purpose is given for a period ID
+	ErrEmptyPurpose = errors.New("machid: purpose cannot be empty")
+)
+
+// Period is the length of the interval a period ID is stable for.
+type Period int
+
+const (
+	// PeriodDay changes the ID every day
+	PeriodDay Period = iota + 1
+
+	// PeriodWeek changes the ID every week (see PeriodPolicy.WeekStart)
+	PeriodWeek
+
+	// PeriodMonth changes the ID every calendar month
+	PeriodMonth
+)
+
+// String returns the name of the period.
+func (p Period) String() string {
+	switch p {
+	case PeriodDay:
+		return "day"
+	case PeriodWeek:
+		return "week"
+	case PeriodMonth:
+		return "month"
+	default:
+		return "unknown"
+	}
+}
+
+// Clock provides the current time. Replace it with SetClock in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the default Clock.
+type systemClock struct{}
+
+// Now returns the current system time.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// PeriodPolicy controls where period boundaries fall.
+type PeriodPolicy struct {
+	// Location is the time zone periods are computed in. Defaults to UTC, so
+	// all hosts switch periods at the same instant; use time.Local for periods
+	// following the host's local calendar.
+	Location *time.Location
+
+	// Offset shifts every boundary from midnight, e.g. 4*time.Hour starts
+	// each period at 04:00 instead of 00:00.
+	Offset time.Duration
+
+	// WeekStart is the first day of a PeriodWeek (Sunday, the zero value, by default).
+	WeekStart time.Weekday
+}
+
+var (
+	// clock configured with SetClock
+	clock   Clock = systemClock{}
+	clockMu sync.RWMutex
+
+	// periodPolicy configured with SetPeriodPolicy
+	periodPolicy   PeriodPolicy
+	periodPolicyMu sync.RWMutex
+)
+
+// SetClock sets the clock used for period IDs, eMachID rotation and history,
+// rollback detection and metering. Pass nil to restore the system clock.
+//
+// Parameters:
+//   - c: The clock to use
+func SetClock(c Clock) {
+	clockMu.Lock()
+	defer clockMu.Unlock()
+	if c == nil {
+		c = systemClock{}
+	}
+	clock = c
+}
+
+// now returns the current time from the configured clock.
+func now() time.Time {
+	clockMu.RLock()
+	defer clockMu.RUnlock()
+	return clock.Now()
+}
+
+// SetPeriodPolicy sets the time zone and boundaries used for period IDs.
+//
+// Parameters:
+//   - policy: The period policy to use
+func SetPeriodPolicy(policy PeriodPolicy) {
+	periodPolicyMu.Lock()
+	defer periodPolicyMu.Unlock()
+	periodPolicy = policy
+}
+
+// GetPeriodPolicy returns the current period policy.
+func GetPeriodPolicy() PeriodPolicy {
+	periodPolicyMu.RLock()
+	defer periodPolicyMu.RUnlock()
+	return periodPolicy
+}
+
+// Bounds returns the start (inclusive) and end (exclusive) of the period
+// containing t.
+//
+// Parameters:
+//   - period: The period length
+//   - t: Any time within the period
+func (p PeriodPolicy) Bounds(period Period, t time.Time) (start, end time.Time, err error) {
+	loc := p.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	shifted := t.In(loc).Add(-p.Offset)
+	year, month, day := shifted.Date()
+
+	switch period {
+	case PeriodDay:
+		start = time.Date(year, month, day, 0, 0, 0, 0, loc)
+		end = time.Date(year, month, day+1, 0, 0, 0, 0, loc)
+	case PeriodWeek:
+		day -= (int(shifted.Weekday()) - int(p.WeekStart) + 7) % 7
+		start = time.Date(year, month, day, 0, 0, 0, 0, loc)
+		end = time.Date(year, month, day+7, 0, 0, 0, 0, loc)
+	case PeriodMonth:
+		start = time.Date(year, month, 1, 0, 0, 0, 0, loc)
+		end = time.Date(year, month+1, 1, 0, 0, 0, 0, loc)
+	default:
+		return time.Time{}, time.Time{}, ErrInvalidPeriod
+	}
+	return start.Add(p.Offset), end.Add(p.Offset), nil
+}
+
+// PeriodKey derives the key that links a host's period IDs from its reMachID.
+// Anyone holding it can compute the host's period ID for any period.
+//
+// Parameters:
+//   - remachid: The host's reMachID
+//
+// Returns:
+//   - A 32-byte period key
+func PeriodKey(remachid string) []byte {
+	mac := hmac.New(sha256.New, []byte(remachid))
+	mac.Write([]byte("machid period key v1"))
+	return mac.Sum(nil)
+}
+
+// DerivePeriodIDWithKey computes the period ID for the period containing t
+// using the current period policy. Key holders use it to link a host's IDs
+// across periods.
+//
+// Parameters:
+//   - key: The host's period key (see PeriodKey)
+//   - purpose: Separates IDs used for different purposes
+//   - period: The period length
+//   - t: Any time within the period
+//
+// Returns:
+//   - The period ID as 32 hex characters
+//   - An error if purpose is empty or period is invalid
+func DerivePeriodIDWithKey(key []byte, purpose string, period Period, t time.Time) (string, error) {
+	if purpose == "" {
+		return "", ErrEmptyPurpose
+	}
+	start, _, err := GetPeriodPolicy().Bounds(period, t)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\x00%s\x00%d", purpose, period, start.Unix())
+	return hex.EncodeToString(mac.Sum(nil)[:16]), nil
+}
+
+// DerivePeriodID returns an ID that is stable for the current period but
+// unlinkable across periods without the period key. The reMachID is obtained
+// through GetOrGenerateReMachID, so root is only needed if it is not cached.
+//
+// Parameters:
+//   - salt: The application salt whose reMachID the period key is derived from
+//   - purpose: Separates IDs used for different purposes, e.g. "telemetry"
+//   - period: PeriodDay, PeriodWeek or PeriodMonth
+//
+// Returns:
+//   - The period ID as 32 hex characters
+//   - An error if the reMachID cannot be obtained, purpose is empty or
+//     period is invalid
+func DerivePeriodID(salt, purpose string, period Period) (string, error) {
+	if salt == "" {
+		return "", ErrEmptySalt
+	}
+	if purpose == "" {
+		return "", ErrEmptyPurpose
+	}
+	if period < PeriodDay || period > PeriodMonth {
+		return "", ErrInvalidPeriod
+	}
+
+	remachid, _, err := GetOrGenerateReMachID(salt)
+	if err != nil {
+		return "", err
+	}
+	key := PeriodKey(remachid)
+	clearString(&remachid)
+	return DerivePeriodIDWithKey(key, purpose, period, now())
+}
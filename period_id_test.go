@@ -0,0 +1,97 @@
+package machid
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.t }
+
+func useFakeClock(t *testing.T, at time.Time) *fakeClock {
+	t.Helper()
+	c := &fakeClock{t: at}
+	SetClock(c)
+	t.Cleanup(func() { SetClock(nil) })
+	return c
+}
+
+func usePeriodPolicy(t *testing.T, policy PeriodPolicy) {
+	t.Helper()
+	SetPeriodPolicy(policy)
+	t.Cleanup(func() { SetPeriodPolicy(PeriodPolicy{}) })
+}
+
+func TestPeriodPolicy_Bounds(t *testing.T) {
+	at := time.Date(2026, 10, 14, 2, 30, 0, 0, time.UTC) // A Wednesday
+
+	tests := []struct {
+		name   string
+		policy PeriodPolicy
+		period Period
+		start  time.Time
+		end    time.Time
+	}{
+		{"day", PeriodPolicy{}, PeriodDay,
+			time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)},
+		{"day with offset", PeriodPolicy{Offset: 4 * time.Hour}, PeriodDay,
+			time.Date(2026, 10, 13, 4, 0, 0, 0, time.UTC), time.Date(2026, 10, 14, 4, 0, 0, 0, time.UTC)},
+		{"week from Sunday", PeriodPolicy{}, PeriodWeek,
+			time.Date(2026, 10, 11, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"week from Monday", PeriodPolicy{WeekStart: time.Monday}, PeriodWeek,
+			time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{"month", PeriodPolicy{}, PeriodMonth,
+			time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{"day in another zone", PeriodPolicy{Location: time.FixedZone("UTC-5", -5*3600)}, PeriodDay,
+			time.Date(2026, 10, 13, 5, 0, 0, 0, time.UTC), time.Date(2026, 10, 14, 5, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		start, end, err := tt.policy.Bounds(tt.period, at)
+		if err != nil || !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Errorf("%s: Bounds() = %v, %v, %v; expected %v, %v", tt.name, start, end, err, tt.start, tt.end)
+		}
+	}
+
+	if _, _, err := (PeriodPolicy{}).Bounds(Period(0), at); !errors.Is(err, ErrInvalidPeriod) {
+		t.Errorf("Bounds() with an invalid period expected ErrInvalidPeriod, got: %v", err)
+	}
+}
+
+func TestDerivePeriodID(t *testing.T) {
+	useMemoryCacheStore(t)
+	if err := SaveCachedIDs(&CachedMachineIDs{ReMachID: "cached-remachid", Salt: "test-salt"}); err != nil {
+		t.Fatal(err)
+	}
+	clock := useFakeClock(t, time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC))
+
+	morning, err := DerivePeriodID("test-salt", "telemetry", PeriodDay)
+	if err != nil {
+		t.Fatalf("DerivePeriodID() failed: %v", err)
+	}
+	clock.t = clock.t.Add(10 * time.Hour)
+	evening, _ := DerivePeriodID("test-salt", "telemetry", PeriodDay)
+	if morning != evening {
+		t.Error("DerivePeriodID() changed within a day")
+	}
+
+	clock.t = clock.t.Add(24 * time.Hour)
+	nextDay, _ := DerivePeriodID("test-salt", "telemetry", PeriodDay)
+	if nextDay == morning {
+		t.Error("DerivePeriodID() did not change across days")
+	}
+	if other, _ := DerivePeriodID("test-salt", "crash-reports", PeriodDay); other == nextDay {
+		t.Error("DerivePeriodID() is the same for different purposes")
+	}
+
+	// Key holders can link the periods
+	linked, err := DerivePeriodIDWithKey(PeriodKey("cached-remachid"), "telemetry", PeriodDay, clock.t.Add(-24*time.Hour))
+	if err != nil || linked != morning {
+		t.Errorf("DerivePeriodIDWithKey() = %q, %v; expected %q", linked, err, morning)
+	}
+
+	if _, err := DerivePeriodID("test-salt", "", PeriodDay); !errors.Is(err, ErrEmptyPurpose) {
+		t.Errorf("DerivePeriodID() with empty purpose expected ErrEmptyPurpose, got: %v", err)
+	}
+}
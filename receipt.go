@@ -0,0 +1,301 @@
+package machid
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// ================================================================================
+// Signed Usage Receipts
+// ================================================================================
+//
+// A usage receipt states how far a metering counter advanced over a range of
+// its values, when, and at which tip of the counter journal. It is signed with
+// an Ed25519 machine key derived from the reMachID, the application salt and a
+// random root-only secret. The reMachID ties the key to the machine identity;
+// the secret, unlike the cached reMachID the user can read, keeps users from
+// signing receipts themselves. The vendor records the machine's public key at
+// enrollment and verifies receipts exported from an offline machine without
+// contacting it; contiguous receipts also reveal a counter that was rewound
+// between exports.
+
+// Usage receipt errors
+var (
+	// ErrInvalidReceipt is returned when a usage receipt is malformed or its
+	// range is empty
+	ErrInvalidReceipt = errors.New("machid: invalid usage receipt")
+
+	// ErrReceiptSignature is returned when a usage receipt was not signed by
+	// the expected machine key
+	ErrReceiptSignature = errors.New("machid: usage receipt signature is invalid")
+
+	// ErrReceiptGap is returned when consecutive usage receipts of a counter
+	// leave a gap or overlap
+	ErrReceiptGap = errors.New("machid: usage receipts are not contiguous")
+)
+
+// usageReceiptVersion is the receipt format version
+const usageReceiptVersion = 1
+
+// receiptKeyFile holds the secret machine signing keys are derived from
+const receiptKeyFile = "receipt.key"
+
+// receiptKeyDir is the root-only directory of the receipt key secret, kept
+// apart from the fallback directory so it does not enable the ledger
+var receiptKeyDir = "/var/lib/machid"
+
+// receiptKeyPath returns the location of the receipt key secret.
+func receiptKeyPath() string {
+	return filepath.Join(receiptKeyDir, receiptKeyFile)
+}
+
+// UsageReceipt is a signed statement of a counter's usage. It is exported as
+// JSON.
+type UsageReceipt struct {
+	Version   int     `json:"version"`
+	Namespace string  `json:"namespace"`
+	Counter   Counter `json:"counter"`
+
+	// The receipt covers the counter values From (exclusive) to To (inclusive)
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+
+	Start    time.Time `json:"start"` // Time of the first increment in the range, or of the compacted checkpoint holding it
+	End      time.Time `json:"end"`   // Time of the last increment in the range
+	IssuedAt time.Time `json:"issued_at"`
+
+	// Tip of the counter journal when the receipt was issued
+	JournalSeq uint64 `json:"journal_seq"`
+	JournalTip string `json:"journal_tip"`
+
+	MachineKey ed25519.PublicKey `json:"machine_key"`
+	Signature  []byte            `json:"signature"`
+}
+
+// Usage returns the amount the counter advanced over the receipt's range.
+func (r *UsageReceipt) Usage() uint64 {
+	return r.To - r.From
+}
+
+// Checkpoint returns the journal tip the receipt was issued at, to detect a
+// later rewind of the journal with VerifyJournal.
+func (r *UsageReceipt) Checkpoint() *JournalCheckpoint {
+	return &JournalCheckpoint{
+		Namespace: r.Namespace,
+		Seq:       r.JournalSeq,
+		Hash:      r.JournalTip,
+		Time:      r.IssuedAt,
+		Counters:  map[Counter]uint64{r.Counter: r.To},
+	}
+}
+
+// signedData returns the bytes covered by the signature.
+func (r UsageReceipt) signedData() []byte {
+	r.Signature = nil
+	r.Start, r.End, r.IssuedAt = r.Start.UTC(), r.End.UTC(), r.IssuedAt.UTC()
+	data, _ := json.Marshal(r)
+	return append([]byte("machid usage receipt\x00"), data...)
+}
+
+// MachineSigningKey returns the Ed25519 key that signs this machine's usage
+// receipts for an application. It is derived from the salt's reMachID and a
+// random secret readable only by root (/var/lib/machid/receipt.key), which is
+// created on first use. The key rotates whenever the reMachID changes, so
+// the new public key must then be enrolled again. Only its public half should
+// leave the machine.
+//
+// Parameters:
+//   - salt: The application salt, so applications get unrelated keys
+//
+// Returns:
+//   - The machine's private signing key
+//   - ErrNotRoot, ErrEmptySalt, ErrNoWriteMode if the secret does not exist
+//     yet in no-write mode, or an error if the reMachID or secret cannot be
+//     obtained
+func MachineSigningKey(salt string) (ed25519.PrivateKey, error) {
+	if err := checkRoot(); err != nil {
+		return nil, err
+	}
+	if salt == "" {
+		return nil, ErrEmptySalt
+	}
+	secret, err := readOrCreateKeyFile(receiptKeyPath())
+	if err != nil {
+		return nil, err
+	}
+	remachid, _, err := GetOrGenerateReMachID(salt)
+	if err != nil {
+		return nil, err
+	}
+	key := machineSigningKey(secret, remachid, salt)
+	clearString(&remachid)
+	return key, nil
+}
+
+// machineSigningKey derives the signing key for a reMachID and salt from secret.
+func machineSigningKey(secret []byte, remachid, salt string) ed25519.PrivateKey {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("machid usage receipt key v2\x00"))
+	mac.Write([]byte(remachid))
+	mac.Write([]byte{0})
+	mac.Write([]byte(salt))
+	return ed25519.NewKeyFromSeed(mac.Sum(nil))
+}
+
+// MachinePublicKey returns the public key that verifies this machine's usage
+// receipts, to be recorded by the vendor at enrollment. Requires root.
+//
+// Parameters:
+//   - salt: The application salt
+//
+// Returns:
+//   - The Ed25519 public key
+//   - An error from MachineSigningKey
+func MachinePublicKey(salt string) (ed25519.PublicKey, error) {
+	key, err := MachineSigningKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	return key.Public().(ed25519.PublicKey), nil
+}
+
+// IssueUsageReceipt signs a receipt for the usage of a counter since the
+// value from, typically the To of the previous receipt (0 for the first).
+// The counter journal of the salt's namespace is verified first. Requires
+// root, since only root can read the machine key's secret.
+//
+// Parameters:
+//   - salt: The application salt, which selects the machine key and namespace
+//   - counter: The metering counter
+//   - from: The counter value the receipt starts after
+//
+// Returns:
+//   - The signed receipt
+//   - ErrInvalidReceipt if the counter did not advance past from, an error
+//     wrapping ErrJournalTampered or ErrJournalRewound if the journal fails
+//     verification, or an error from MachineSigningKey
+func IssueUsageReceipt(salt string, counter Counter, from uint64) (*UsageReceipt, error) {
+	if counter == "" {
+		return nil, ErrEmptyCounter
+	}
+	key, err := MachineSigningKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	// GetOrGenerateReMachID selected the salt's namespace
+	return issueUsageReceipt(key, currentNamespace(), counter, from, now())
+}
+
+// issueUsageReceipt signs a receipt from the journal of namespace name.
+func issueUsageReceipt(key ed25519.PrivateKey, name string, counter Counter, from uint64, t time.Time) (*UsageReceipt, error) {
+	state, err := readVerifiedJournal(name)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := &UsageReceipt{
+		Version:    usageReceiptVersion,
+		Namespace:  name,
+		Counter:    counter,
+		From:       from,
+		To:         state.counters[counter],
+		IssuedAt:   t.UTC(),
+		JournalTip: state.tip(),
+		MachineKey: key.Public().(ed25519.PublicKey),
+	}
+	if receipt.To <= from {
+		return nil, fmt.Errorf("%w: counter %q did not advance past %d", ErrInvalidReceipt, counter, from)
+	}
+	if base := state.records[0]; state.first() > 1 && base.Checkpoint[counter] > from {
+		// Part of the range was compacted into the journal's first checkpoint
+		receipt.Start = time.Unix(0, base.Time).UTC()
+		receipt.End = receipt.Start
+	}
+	for _, r := range state.records {
+		if r.Counter != counter || r.Value <= from {
+			continue
+		}
+		if receipt.Start.IsZero() {
+			receipt.Start = time.Unix(0, r.Time).UTC()
+		}
+		receipt.End = time.Unix(0, r.Time).UTC()
+	}
+	receipt.JournalSeq = state.records[len(state.records)-1].Seq
+
+	receipt.Signature = ed25519.Sign(key, receipt.signedData())
+	return receipt, nil
+}
+
+// UsageReceiptVerifier verifies usage receipts offline against a machine's
+// public key (see MachinePublicKey).
+type UsageReceiptVerifier struct {
+	PublicKey ed25519.PublicKey
+}
+
+// Verify checks the receipt's signature and well-formedness.
+//
+// Parameters:
+//   - receipt: The usage receipt
+//
+// Returns:
+//   - ErrReceiptSignature if it was not signed by the verifier's machine key,
+//     or ErrInvalidReceipt if it is malformed
+func (v *UsageReceiptVerifier) Verify(receipt *UsageReceipt) error {
+	if receipt == nil || receipt.Version != usageReceiptVersion {
+		return fmt.Errorf("%w: unsupported version", ErrInvalidReceipt)
+	}
+	if len(v.PublicKey) != ed25519.PublicKeySize || !bytes.Equal(receipt.MachineKey, v.PublicKey) {
+		return fmt.Errorf("%w: issued by another machine key", ErrReceiptSignature)
+	}
+	if !ed25519.Verify(v.PublicKey, receipt.signedData(), receipt.Signature) {
+		return ErrReceiptSignature
+	}
+	if receipt.Counter == "" || receipt.To <= receipt.From || receipt.End.Before(receipt.Start) || receipt.JournalSeq == 0 {
+		return fmt.Errorf("%w: empty range", ErrInvalidReceipt)
+	}
+	return nil
+}
+
+// VerifySequence verifies receipts in the order they were issued and checks
+// that the receipts of each counter are contiguous, so no usage was hidden
+// by rewinding the counter between exports.
+//
+// Parameters:
+//   - receipts: Receipts of one machine, oldest first
+//
+// Returns:
+//   - The total usage per namespace and counter, since the same counter name
+//     counts separately in each namespace
+//   - An error from Verify, or ErrReceiptGap if consecutive receipts of a
+//     counter leave a gap or overlap
+func (v *UsageReceiptVerifier) VerifySequence(receipts []*UsageReceipt) (map[string]map[Counter]uint64, error) {
+	type counterKey struct {
+		namespace string
+		counter   Counter
+	}
+	last := make(map[counterKey]*UsageReceipt)
+	totals := make(map[string]map[Counter]uint64)
+
+	for i, receipt := range receipts {
+		if err := v.Verify(receipt); err != nil {
+			return nil, fmt.Errorf("receipt %d: %w", i, err)
+		}
+		key := counterKey{receipt.Namespace, receipt.Counter}
+		if prev := last[key]; prev != nil && (receipt.From != prev.To || receipt.JournalSeq < prev.JournalSeq) {
+			return nil, fmt.Errorf("%w: receipt %d for %q starts at %d, previous ended at %d", ErrReceiptGap, i, receipt.Counter, receipt.From, prev.To)
+		}
+		last[key] = receipt
+		if totals[receipt.Namespace] == nil {
+			totals[receipt.Namespace] = make(map[Counter]uint64)
+		}
+		totals[receipt.Namespace][receipt.Counter] += receipt.Usage()
+	}
+	return totals, nil
+}
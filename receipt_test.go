@@ -0,0 +1,174 @@
+package machid
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func useTempReceiptKey(t *testing.T) {
+	t.Helper()
+	old := receiptKeyDir
+	receiptKeyDir = filepath.Join(t.TempDir(), "machid")
+	t.Cleanup(func() { receiptKeyDir = old })
+}
+
+func TestIssueUsageReceipt(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	useMemoryCacheStore(t)
+	useTempReceiptKey(t)
+	if err := SaveCachedIDs(&CachedMachineIDs{ReMachID: "cached-remachid", Salt: "test-salt"}); err != nil {
+		t.Fatal(err)
+	}
+	IncrementCounter("api_calls", 3)
+	IncrementCounter("exports", 1)
+	IncrementCounter("api_calls", 2)
+
+	publicKey, err := MachinePublicKey("test-salt")
+	if err != nil {
+		t.Fatalf("MachinePublicKey() failed: %v", err)
+	}
+	first, err := IssueUsageReceipt("test-salt", "api_calls", 0)
+	if err != nil || first.From != 0 || first.To != 5 || first.JournalSeq != 3 || first.Start.After(first.End) {
+		t.Fatalf("IssueUsageReceipt() = %+v, %v", first, err)
+	}
+	if _, err := IssueUsageReceipt("test-salt", "api_calls", 5); !errors.Is(err, ErrInvalidReceipt) {
+		t.Errorf("IssueUsageReceipt() without new usage expected ErrInvalidReceipt, got: %v", err)
+	}
+	if _, err := VerifyJournal(first.Checkpoint()); err != nil {
+		t.Errorf("VerifyJournal(receipt checkpoint) failed: %v", err)
+	}
+
+	IncrementCounter("api_calls", 4)
+	second, err := IssueUsageReceipt("test-salt", "api_calls", first.To)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Receipts survive the JSON export to the verifier
+	data, err := json.Marshal([]*UsageReceipt{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := os.ReadFile(receiptKeyPath())
+	if len(secret) == 0 || strings.Contains(string(data), string(secret)) {
+		t.Fatal("usage receipt reveals the receipt key secret")
+	}
+	if fi, _ := os.Stat(receiptKeyPath()); fi.Mode().Perm() != 0600 {
+		t.Errorf("receipt key mode = %04o, expected 0600", fi.Mode().Perm())
+	}
+	var exported []*UsageReceipt
+	if err := json.Unmarshal(data, &exported); err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := &UsageReceiptVerifier{PublicKey: publicKey}
+	totals, err := verifier.VerifySequence(exported)
+	if err != nil || totals[first.Namespace]["api_calls"] != 9 {
+		t.Errorf("VerifySequence() = %v, %v; expected 9 api_calls", totals, err)
+	}
+
+	// The key is stable and bound to the reMachID
+	if again, err := MachinePublicKey("test-salt"); err != nil || !again.Equal(publicKey) {
+		t.Errorf("MachinePublicKey() changed between calls: %v", err)
+	}
+	raw, _ := hex.DecodeString(string(secret))
+	expected := machineSigningKey(raw, "cached-remachid", "test-salt").Public().(ed25519.PublicKey)
+	if !expected.Equal(publicKey) {
+		t.Error("MachinePublicKey() is not derived from the reMachID")
+	}
+}
+
+func TestMachineSigningKey_Derivation(t *testing.T) {
+	base := machineSigningKey([]byte("secret"), "remachid", "salt")
+	cases := map[string]ed25519.PrivateKey{
+		"secret":   machineSigningKey([]byte("other-secret"), "remachid", "salt"),
+		"reMachID": machineSigningKey([]byte("secret"), "other-remachid", "salt"),
+		"salt":     machineSigningKey([]byte("secret"), "remachid", "other-salt"),
+	}
+	for name, key := range cases {
+		if key.Equal(base) {
+			t.Errorf("machineSigningKey() with another %s = same key", name)
+		}
+	}
+}
+
+func TestMachineSigningKey_NoWriteMode(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	useMemoryCacheStore(t)
+	useTempReceiptKey(t)
+	SetNoWriteMode(true)
+	t.Cleanup(func() { SetNoWriteMode(false) })
+
+	if _, err := MachineSigningKey("test-salt"); !errors.Is(err, ErrNoWriteMode) {
+		t.Errorf("MachineSigningKey() in no-write mode expected ErrNoWriteMode, got: %v", err)
+	}
+	if _, err := os.Stat(receiptKeyDir); !os.IsNotExist(err) {
+		t.Errorf("MachineSigningKey() in no-write mode created %s", receiptKeyDir)
+	}
+}
+
+func TestVerifySequence_NamespaceTotals(t *testing.T) {
+	useMemoryCacheStore(t)
+	key := machineSigningKey([]byte("receipt-secret"), "host-remachid", "test-salt")
+	verifier := &UsageReceiptVerifier{PublicKey: key.Public().(ed25519.PublicKey)}
+
+	var receipts []*UsageReceipt
+	for _, ns := range []string{"app-a", "app-b"} {
+		SetCacheNamespace(ns)
+		IncrementCounter("exports", 2)
+		receipt, err := issueUsageReceipt(key, currentNamespace(), "exports", 0, now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		receipts = append(receipts, receipt)
+	}
+
+	// The same counter in two namespaces is neither a gap nor summed together
+	totals, err := verifier.VerifySequence(receipts)
+	if err != nil || totals["app-a"]["exports"] != 2 || totals["app-b"]["exports"] != 2 {
+		t.Errorf("VerifySequence() = %v, %v; expected 2 exports per namespace", totals, err)
+	}
+}
+
+func TestUsageReceiptVerifier_Rejects(t *testing.T) {
+	useMemoryCacheStore(t)
+	key := machineSigningKey([]byte("host-secret"), "host-remachid", "test-salt")
+	IncrementCounter("exports", 2)
+	receipt, err := issueUsageReceipt(key, currentNamespace(), "exports", 0, now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := &UsageReceiptVerifier{PublicKey: key.Public().(ed25519.PublicKey)}
+	if err := verifier.Verify(receipt); err != nil {
+		t.Fatalf("Verify() failed: %v", err)
+	}
+
+	// Another machine's key
+	other := &UsageReceiptVerifier{PublicKey: machineSigningKey([]byte("other-secret"), "other-remachid", "test-salt").Public().(ed25519.PublicKey)}
+	if err := other.Verify(receipt); !errors.Is(err, ErrReceiptSignature) {
+		t.Errorf("Verify() with another machine's key expected ErrReceiptSignature, got: %v", err)
+	}
+
+	// Altered usage
+	altered := *receipt
+	altered.To = 1000
+	if err := verifier.Verify(&altered); !errors.Is(err, ErrReceiptSignature) {
+		t.Errorf("Verify() of an altered receipt expected ErrReceiptSignature, got: %v", err)
+	}
+
+	// A rewound counter re-reports usage that was already billed
+	if _, err := verifier.VerifySequence([]*UsageReceipt{receipt, receipt}); !errors.Is(err, ErrReceiptGap) {
+		t.Errorf("VerifySequence() with overlapping receipts expected ErrReceiptGap, got: %v", err)
+	}
+}
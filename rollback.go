@@ -0,0 +1,395 @@
+package machid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ================================================================================
+// Snapshot and Clock Rollback Detection
+// ================================================================================
+//
+// Restoring a VM snapshot or a backup of the cache rolls the cached eMachID and
+// its action count back, so an eMachID is reused with counts that were already
+// consumed. With a RollbackPolicy, every eMachID generation and action count
+// handed out is recorded as a high-water mark in a separate watermark store.
+// The cache is checked against it, and the kernel boot ID and CLOCK_BOOTTIME
+// against the wall clock, to detect a resumed snapshot or a clock set back.
+//
+// The watermark must not be restored together with the cache, so by default
+// it is kept in the kernel keyring rather than next to cache.json. The keyring
+// is not durable: it is emptied on reboot, the persistent keyring expires
+// after a few idle days, and a resumed VM memory snapshot restores it along
+// with the cache. The default therefore only catches a cache restored from a
+// backup while the keyring lives; detecting restored VM or disk snapshots
+// needs a durable store outside the machine (SetWatermarkStore). A lost
+// watermark is logged when a cache that already issued an eMachID is checked.
+// Where the keyring is unavailable (other platforms, containers whose seccomp
+// profile blocks keyctl) there is no default at all.
+
+// ErrStateRollback is returned (wrapped in a *RollbackError) when the cached
+// ephemeral state is older than what was already issued
+var ErrStateRollback = errors.New("machid: ephemeral state rolled back")
+
+// DefaultClockTolerance is the clock drift tolerated when no ClockTolerance is set
+const DefaultClockTolerance = 2 * time.Minute
+
+// Rollback reasons
+const (
+	RollbackReasonStateBehind     = "cache is older than the high-water mark"
+	RollbackReasonSnapshotRestore = "host resumed from a snapshot"
+	RollbackReasonClockRollback   = "wall clock moved backwards"
+)
+
+// RollbackError describes a detected rollback of the ephemeral state.
+// It wraps ErrStateRollback.
+type RollbackError struct {
+	Namespace string // Cache namespace of the rolled back state
+	Reason    string // One of the RollbackReason* constants
+}
+
+func (e *RollbackError) Error() string {
+	return fmt.Sprintf("%v: %s (namespace %q)", ErrStateRollback, e.Reason, e.Namespace)
+}
+
+func (e *RollbackError) Unwrap() error {
+	return ErrStateRollback
+}
+
+// RollbackAction selects how a detected rollback is handled.
+type RollbackAction int
+
+const (
+	// RollbackIgnore disables rollback detection (the default)
+	RollbackIgnore RollbackAction = iota
+
+	// RollbackRotate rotates the eMachID in GetOrGenerateEMachID
+	RollbackRotate
+
+	// RollbackFail returns a *RollbackError from GetOrGenerateEMachID
+	RollbackFail
+)
+
+// RollbackPolicy configures rollback detection. IncrementActionCount returns a
+// *RollbackError on a detected rollback with either action, since it cannot
+// rotate the eMachID; RotateEMachID always accepts the current state.
+type RollbackPolicy struct {
+	// Action is taken when a rollback is detected
+	Action RollbackAction
+
+	// ClockTolerance is how far the wall clock may move against the boot
+	// clock before a resumed snapshot or a clock rollback is assumed.
+	// Zero uses DefaultClockTolerance.
+	ClockTolerance time.Duration
+}
+
+var (
+	rollbackPolicy   RollbackPolicy
+	rollbackPolicyMu sync.RWMutex
+
+	// watermarkStore overrides the default watermark location when non-nil
+	watermarkStore   CacheStore
+	watermarkStoreMu sync.RWMutex
+
+	// Key description of the default watermark in the kernel keyring
+	watermarkKeyDescription = "machid:watermark"
+
+	// warnNoWatermark warns once that no watermark store is available
+	warnNoWatermark sync.Once
+
+	// uptimePath reports CLOCK_BOOTTIME, which keeps counting during suspend
+	uptimePath = "/proc/uptime"
+)
+
+// SetRollbackPolicy sets how rollbacks of the ephemeral state are detected
+// and handled.
+//
+// Parameters:
+//   - policy: The rollback policy to use
+func SetRollbackPolicy(policy RollbackPolicy) {
+	rollbackPolicyMu.Lock()
+	defer rollbackPolicyMu.Unlock()
+	rollbackPolicy = policy
+}
+
+// GetRollbackPolicy returns the current rollback policy.
+func GetRollbackPolicy() RollbackPolicy {
+	rollbackPolicyMu.RLock()
+	defer rollbackPolicyMu.RUnlock()
+	return rollbackPolicy
+}
+
+// SetWatermarkStore sets where the high-water mark is stored. It must not be
+// restored together with the cache; durable storage outside the VM snapshot
+// (e.g. a separate volume) is needed to detect restored VM or disk snapshots.
+// Pass nil to restore the default (the invoking user's persistent kernel
+// keyring, if available), which does not survive a reboot or a few idle days.
+// Without a kernel keyring, a store must be set for rollback detection and
+// journal anchoring to work.
+func SetWatermarkStore(store CacheStore) {
+	watermarkStoreMu.Lock()
+	defer watermarkStoreMu.Unlock()
+	watermarkStore = store
+}
+
+// GetWatermarkStore returns the store configured with SetWatermarkStore,
+// or nil if the default is used.
+func GetWatermarkStore() CacheStore {
+	watermarkStoreMu.RLock()
+	defer watermarkStoreMu.RUnlock()
+	return watermarkStore
+}
+
+// activeWatermarkStore returns the store the watermark is kept in, or nil if
+// none is configured and the kernel keyring is unavailable.
+func activeWatermarkStore() CacheStore {
+	if store := GetWatermarkStore(); store != nil {
+		return store
+	}
+	if keyringAvailable() {
+		return &KeyringCacheStore{Description: watermarkKeyDescription, Keyring: KeyringPersistent}
+	}
+	warnNoWatermark.Do(func() {
+		logWarning("WARNING: machid - Kernel keyring unavailable and no watermark store set (see SetWatermarkStore); rollback detection and journal anchoring are disabled")
+	})
+	return nil
+}
+
+// tolerance returns the effective clock tolerance.
+func (p RollbackPolicy) tolerance() time.Duration {
+	if p.ClockTolerance > 0 {
+		return p.ClockTolerance
+	}
+	return DefaultClockTolerance
+}
+
+// watermark is the high-water mark of the issued ephemeral state.
+type watermark struct {
+	BootID   string `json:"boot_id,omitempty"`
+	BootTime int64  `json:"boot_time,omitempty"` // Unix nanoseconds of the boot (wall clock minus uptime)
+	Uptime   int64  `json:"uptime,omitempty"`    // CLOCK_BOOTTIME in nanoseconds at the last record
+	WallTime int64  `json:"wall_time"`           // Unix nanoseconds of the last record
+
+	Namespaces map[string]watermarkEntry `json:"namespaces,omitempty"`
+}
+
+// watermarkEntry is the highest state issued for a namespace.
+type watermarkEntry struct {
+	Generation  uint64 `json:"generation"`
+	ActionCount int    `json:"action_count"`
+
+	// Tip of the counter journal (see VerifyJournal)
+	JournalSeq  uint64 `json:"journal_seq,omitempty"`
+	JournalHash string `json:"journal_hash,omitempty"`
+}
+
+// readUptime returns CLOCK_BOOTTIME, or false if it is unavailable.
+func readUptime() (time.Duration, bool) {
+	data, err := os.ReadFile(uptimePath)
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// loadWatermark reads the watermark from store. A missing watermark or store
+// is not an error; an unreadable watermark is logged and ignored.
+func loadWatermark(store CacheStore) (*watermark, error) {
+	if store == nil {
+		return nil, nil
+	}
+	data, err := store.Load()
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var mark watermark
+	if err := json.Unmarshal(data, &mark); err != nil {
+		logWarning(fmt.Sprintf("WARNING: machid - Ignoring unreadable watermark: %v", err))
+		return nil, nil
+	}
+	return &mark, nil
+}
+
+// check returns why cache (belonging to namespace name) was rolled back at t,
+// or "" if no rollback was detected.
+func (m *watermark) check(name string, cache *CachedMachineIDs, t time.Time, tolerance time.Duration) string {
+	if m == nil {
+		return ""
+	}
+
+	if entry, ok := m.Namespaces[name]; ok && cache.EMachID != "" {
+		if cache.EMachIDGeneration < entry.Generation ||
+			cache.EMachIDGeneration == entry.Generation && cache.ActionCount < entry.ActionCount {
+			return RollbackReasonStateBehind
+		}
+	}
+
+	// Within one boot the boot clock only moves forward, and the boot time
+	// derived from it only changes when the wall clock jumps: forward after
+	// a snapshot was resumed, backward when the clock was set back
+	wall := t.UnixNano()
+	if uptime, ok := readUptime(); ok && m.BootID != "" && m.BootID == readBootID() {
+		if int64(uptime) < m.Uptime {
+			return RollbackReasonSnapshotRestore
+		}
+		drift := wall - int64(uptime) - m.BootTime
+		if drift > int64(tolerance) {
+			return RollbackReasonSnapshotRestore
+		}
+		if drift < -int64(tolerance) {
+			return RollbackReasonClockRollback
+		}
+	}
+	if m.WallTime-wall > int64(tolerance) {
+		return RollbackReasonClockRollback
+	}
+	return ""
+}
+
+// recordWatermark raises the high-water mark of namespace name to the given
+// state and records the clocks at t.
+func recordWatermark(name string, issued watermarkEntry, t time.Time) error {
+	if IsNoWriteMode() {
+		return nil
+	}
+	store := activeWatermarkStore()
+	if store == nil {
+		return nil
+	}
+
+	unlock, err := lockCacheStore(store)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	mark, err := loadWatermark(store)
+	if err != nil {
+		return err
+	}
+	if mark == nil {
+		mark = &watermark{}
+	}
+	if mark.Namespaces == nil {
+		mark.Namespaces = make(map[string]watermarkEntry)
+	}
+
+	entry := mark.Namespaces[name]
+	if issued.Generation > entry.Generation {
+		entry.Generation, entry.ActionCount = issued.Generation, issued.ActionCount
+	} else if issued.Generation == entry.Generation {
+		entry.ActionCount = max(entry.ActionCount, issued.ActionCount)
+	}
+	mark.Namespaces[name] = entry
+
+	wall := t.UnixNano()
+	mark.BootID, mark.Uptime, mark.BootTime = readBootID(), 0, 0
+	if uptime, ok := readUptime(); ok {
+		mark.Uptime, mark.BootTime = int64(uptime), wall-int64(uptime)
+	}
+	mark.WallTime = wall
+
+	data, err := json.Marshal(mark)
+	if err != nil {
+		return err
+	}
+	return store.Save(data)
+}
+
+// rollbackGuard checks a cache transaction against the high-water mark and
+// records the state it issued. A nil guard (rollback detection disabled)
+// does nothing.
+type rollbackGuard struct {
+	policy RollbackPolicy
+	mark   *watermark
+	name   string
+	cache  *CachedMachineIDs
+	t      time.Time
+}
+
+// newRollbackGuard returns a guard for the current rollback policy, or nil if
+// detection is disabled.
+func newRollbackGuard() *rollbackGuard {
+	policy := GetRollbackPolicy()
+	if policy.Action == RollbackIgnore {
+		return nil
+	}
+	return &rollbackGuard{policy: policy}
+}
+
+// check loads the watermark and returns why cache was rolled back at t, or ""
+// if no rollback was detected. Must be called within the cache transaction.
+func (g *rollbackGuard) check(cache *CachedMachineIDs, t time.Time) string {
+	if g == nil {
+		return ""
+	}
+	g.name, g.cache, g.t = currentNamespace(), cache, t
+
+	store := activeWatermarkStore()
+	mark, err := loadWatermark(store)
+	if err != nil {
+		logWarning(fmt.Sprintf("WARNING: machid - Failed to read watermark: %v", err))
+	}
+	g.mark = mark
+
+	// An eMachID was issued before, so its watermark was lost (e.g. the
+	// keyring was cleared by a reboot or expired) and rollbacks go unnoticed
+	var known bool
+	if mark != nil {
+		_, known = mark.Namespaces[g.name]
+	}
+	if store != nil && err == nil && !known && cache.EMachIDGeneration > 0 {
+		logWarning(fmt.Sprintf("WARNING: machid - No watermark for namespace %q at eMachID generation %d; a rollback to this state cannot be detected (see SetWatermarkStore)", g.name, cache.EMachIDGeneration))
+	}
+	return mark.check(g.name, cache, t, g.policy.tolerance())
+}
+
+// fails reports whether a rollback must be returned as an error.
+func (g *rollbackGuard) fails() bool {
+	return g != nil && g.policy.Action == RollbackFail
+}
+
+// error returns the *RollbackError for reason.
+func (g *rollbackGuard) error(reason string) error {
+	return &RollbackError{Namespace: g.name, Reason: reason}
+}
+
+// raise lifts the generation of cache to the high-water mark before a new
+// eMachID is stored, so a cleared cache does not reuse old generations.
+func (g *rollbackGuard) raise(cache *CachedMachineIDs) {
+	if g == nil || g.mark == nil {
+		return
+	}
+	if entry := g.mark.Namespaces[g.name]; entry.Generation > cache.EMachIDGeneration {
+		cache.EMachIDGeneration = entry.Generation
+	}
+}
+
+// record raises the high-water mark to the state saved by the transaction.
+func (g *rollbackGuard) record() {
+	if g == nil || g.cache == nil {
+		return
+	}
+	issued := watermarkEntry{Generation: g.cache.EMachIDGeneration, ActionCount: g.cache.ActionCount}
+	if err := recordWatermark(g.name, issued, g.t); err != nil {
+		logWarning(fmt.Sprintf("WARNING: machid - Failed to record watermark: %v", err))
+	}
+}
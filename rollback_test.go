@@ -0,0 +1,195 @@
+package machid
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useRollbackPolicy(t *testing.T, policy RollbackPolicy) *MemoryCacheStore {
+	t.Helper()
+	store := NewMemoryCacheStore()
+	SetRollbackPolicy(policy)
+	SetWatermarkStore(store)
+	t.Cleanup(func() {
+		SetRollbackPolicy(RollbackPolicy{})
+		SetWatermarkStore(nil)
+	})
+	return store
+}
+
+func useTempUptime(t *testing.T, uptime time.Duration) func(time.Duration) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "uptime")
+	set := func(d time.Duration) {
+		os.WriteFile(path, []byte(fmt.Sprintf("%.2f 0.00\n", d.Seconds())), 0600)
+	}
+	set(uptime)
+	old := uptimePath
+	uptimePath = path
+	t.Cleanup(func() { uptimePath = old })
+	return set
+}
+
+func TestRollbackPolicy_RestoredCacheRotates(t *testing.T) {
+	store := useMemoryCacheStore(t)
+	useRollbackPolicy(t, RollbackPolicy{Action: RollbackRotate})
+	events := useRotationPolicy(t, RotationPolicy{})
+
+	first, _, err := GetOrGenerateEMachID("test-salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	IncrementActionCount()
+	snapshot, _ := store.Load()
+	IncrementActionCount()
+
+	// Restore the snapshot: the count was already issued
+	store.Save(snapshot)
+	var rollbackErr *RollbackError
+	if _, err := IncrementActionCount(); !errors.As(err, &rollbackErr) || rollbackErr.Reason != RollbackReasonStateBehind {
+		t.Fatalf("IncrementActionCount() after restore expected RollbackError, got: %v", err)
+	}
+
+	second, fromCache, err := GetOrGenerateEMachID("test-salt")
+	if err != nil || fromCache || second == first {
+		t.Fatalf("GetOrGenerateEMachID() = %q, %v, %v; expected rotation", second, fromCache, err)
+	}
+	if len(*events) != 1 || (*events)[0].Reason != RotationReasonRollback {
+		t.Errorf("unexpected rotation events: %+v", *events)
+	}
+	if count, err := IncrementActionCount(); err != nil || count != 1 {
+		t.Errorf("IncrementActionCount() after rotation = %d, %v", count, err)
+	}
+}
+
+func TestRollbackPolicy_Fail(t *testing.T) {
+	store := useMemoryCacheStore(t)
+	useRollbackPolicy(t, RollbackPolicy{Action: RollbackFail})
+
+	first, _, err := GetOrGenerateEMachID("test-salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, _ := store.Load()
+	if _, err := RotateEMachID("test-salt"); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Save(snapshot)
+	if _, _, err := GetOrGenerateEMachID("test-salt"); !errors.Is(err, ErrStateRollback) {
+		t.Fatalf("GetOrGenerateEMachID() after restore expected ErrStateRollback, got: %v", err)
+	}
+
+	// An explicit rotation accepts the state again
+	rotated, err := RotateEMachID("test-salt")
+	if err != nil || rotated == first {
+		t.Fatalf("RotateEMachID() = %q, %v", rotated, err)
+	}
+	if id, fromCache, err := GetOrGenerateEMachID("test-salt"); err != nil || !fromCache || id != rotated {
+		t.Errorf("GetOrGenerateEMachID() after rotation = %q, %v, %v", id, fromCache, err)
+	}
+
+	// A cleared cache starts a new generation instead of looking rolled back
+	if err := ClearCache(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := GetOrGenerateEMachID("test-salt"); err != nil {
+		t.Errorf("GetOrGenerateEMachID() after ClearCache() failed: %v", err)
+	}
+}
+
+func TestRollbackPolicy_Clocks(t *testing.T) {
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		wall   time.Duration // Wall clock advance
+		uptime time.Duration // Boot clock advance
+		reason string
+	}{
+		{"running", time.Hour, time.Hour, ""},
+		{"clock drift", time.Hour, time.Hour + 30*time.Second, ""},
+		{"snapshot resumed", 24 * time.Hour, time.Minute, RollbackReasonSnapshotRestore},
+		{"boot clock reset", time.Minute, -time.Minute, RollbackReasonSnapshotRestore},
+		{"clock set back", -time.Hour, time.Minute, RollbackReasonClockRollback},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMemoryCacheStore(t)
+			useRollbackPolicy(t, RollbackPolicy{Action: RollbackFail})
+			useTempBootID(t, "6f1b3c2a-9d8e-4f7a-b5c6-1a2b3c4d5e6f")
+			setUptime := useTempUptime(t, time.Hour)
+			clock := useFakeClock(t, start)
+
+			if _, _, err := GetOrGenerateEMachID("test-salt"); err != nil {
+				t.Fatal(err)
+			}
+			clock.t = start.Add(tt.wall)
+			setUptime(time.Hour + tt.uptime)
+
+			_, _, err := GetOrGenerateEMachID("test-salt")
+			var rollbackErr *RollbackError
+			if tt.reason == "" && err != nil {
+				t.Errorf("GetOrGenerateEMachID() failed: %v", err)
+			}
+			if tt.reason != "" && (!errors.As(err, &rollbackErr) || rollbackErr.Reason != tt.reason) {
+				t.Errorf("GetOrGenerateEMachID() expected rollback %q, got: %v", tt.reason, err)
+			}
+		})
+	}
+}
+
+func TestActiveWatermarkStore_OutsideCache(t *testing.T) {
+	SetWatermarkStore(nil)
+
+	switch store := activeWatermarkStore().(type) {
+	case nil:
+		// No kernel keyring: a store must be configured
+	case *KeyringCacheStore:
+		if store.Description != watermarkKeyDescription {
+			t.Errorf("default watermark key description = %q", store.Description)
+		}
+	default:
+		t.Errorf("default watermark store %T may be restored together with the cache", store)
+	}
+
+	configured := NewMemoryCacheStore()
+	SetWatermarkStore(configured)
+	defer SetWatermarkStore(nil)
+	if activeWatermarkStore() != CacheStore(configured) {
+		t.Error("activeWatermarkStore() should return the configured store")
+	}
+}
+
+func TestRollbackPolicy_LostWatermarkWarns(t *testing.T) {
+	useMemoryCacheStore(t)
+	useRollbackPolicy(t, RollbackPolicy{Action: RollbackFail})
+	silenceLogger(t)
+
+	if _, _, err := GetOrGenerateEMachID("test-salt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The watermark is gone, e.g. after a reboot emptied the keyring
+	SetWatermarkStore(NewMemoryCacheStore())
+	var warnings []string
+	SetLogger(func(msg string) { warnings = append(warnings, msg) })
+	if _, err := IncrementActionCount(); err != nil {
+		t.Fatalf("IncrementActionCount() failed: %v", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "No watermark") {
+		t.Errorf("expected one lost-watermark warning, got: %q", warnings)
+	}
+
+	// The mark is recorded again, so the warning is not repeated
+	warnings = nil
+	IncrementActionCount()
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings with a recorded watermark: %q", warnings)
+	}
+}
@@ -0,0 +1,150 @@
+package machid
+
+import (
+	"sync"
+	"time"
+)
+
+// ================================================================================
+// eMachID Rotation Policies
+// ================================================================================
+//
+// GetOrGenerateEMachID evaluates the RotationPolicy against the cached eMachID
+// and transparently replaces it when a limit is reached. Every rotation,
+// including explicit RotateEMachID calls, is reported to the rotation handler.
+
+// RotationPolicy declares when the cached eMachID is rotated. Zero values
+// disable the respective trigger; the default policy never rotates.
+type RotationPolicy struct {
+	// MaxActions rotates once the action count reaches this value
+	MaxActions int
+
+	// MaxAge rotates once the eMachID is older than this
+	MaxAge time.Duration
+
+	// OnReboot rotates when the kernel boot ID changed since the eMachID was generated
+	OnReboot bool
+
+	// OnReMachIDChange rotates when the cached reMachID changed since the
+	// eMachID was generated
+	OnReMachIDChange bool
+}
+
+// Rotation reasons
+const (
+	RotationReasonManual          = "rotated explicitly"
+	RotationReasonMaxActions      = "action count limit reached"
+	RotationReasonMaxAge          = "maximum age reached"
+	RotationReasonReboot          = "host rebooted"
+	RotationReasonReMachIDChanged = "reMachID changed"
+	RotationReasonRollback        = "state rollback detected"
+)
+
+// RotationEvent describes an eMachID rotation.
+type RotationEvent struct {
+	OldID     string    // Previous eMachID
+	NewID     string    // New eMachID
+	Reason    string    // One of the RotationReason* constants
+	Namespace string    // Cache namespace of the eMachID
+	Time      time.Time // Time of the rotation
+}
+
+var (
+	rotationPolicy   RotationPolicy
+	rotationPolicyMu sync.RWMutex
+
+	rotationHandler   func(RotationEvent)
+	rotationHandlerMu sync.RWMutex
+)
+
+// SetRotationPolicy sets when GetOrGenerateEMachID rotates the cached eMachID.
+//
+// Parameters:
+//   - policy: The rotation policy to use
+func SetRotationPolicy(policy RotationPolicy) {
+	rotationPolicyMu.Lock()
+	defer rotationPolicyMu.Unlock()
+	rotationPolicy = policy
+}
+
+// GetRotationPolicy returns the current rotation policy.
+func GetRotationPolicy() RotationPolicy {
+	rotationPolicyMu.RLock()
+	defer rotationPolicyMu.RUnlock()
+	return rotationPolicy
+}
+
+// SetRotationHandler sets a callback that receives a RotationEvent every time
+// the cached eMachID is rotated. Pass nil to remove the handler.
+//
+// The handler is called synchronously after the rotation has been saved.
+func SetRotationHandler(handler func(RotationEvent)) {
+	rotationHandlerMu.Lock()
+	defer rotationHandlerMu.Unlock()
+	rotationHandler = handler
+}
+
+// notifyRotation invokes the rotation handler.
+func notifyRotation(event RotationEvent) {
+	rotationHandlerMu.RLock()
+	handler := rotationHandler
+	rotationHandlerMu.RUnlock()
+	if handler != nil {
+		handler(event)
+	}
+}
+
+// reMachIDFingerprint identifies a reMachID without storing it twice.
+func reMachIDFingerprint(remachid string) string {
+	if remachid == "" {
+		return ""
+	}
+	return hashData("machid rotation binding\x00", remachid)[:16]
+}
+
+// rotationReason returns why the cached eMachID must be rotated at t, or ""
+// if it can be kept.
+func (p RotationPolicy) rotationReason(cache *CachedMachineIDs, t time.Time) string {
+	if p.MaxActions > 0 && cache.ActionCount >= p.MaxActions {
+		return RotationReasonMaxActions
+	}
+	if p.MaxAge > 0 {
+		generated := cache.EMachIDCreatedAt
+		if generated == 0 {
+			generated = cache.CreatedAt
+		}
+		if generated != 0 && t.Sub(time.Unix(generated, 0)) >= p.MaxAge {
+			return RotationReasonMaxAge
+		}
+	}
+	if p.OnReboot && cache.BootID != "" {
+		if bootID := readBootID(); bootID != "" && bootID != cache.BootID {
+			return RotationReasonReboot
+		}
+	}
+	if p.OnReMachIDChange && cache.EMachIDBinding != "" && cache.ReMachID != "" &&
+		cache.EMachIDBinding != reMachIDFingerprint(cache.ReMachID) {
+		return RotationReasonReMachIDChanged
+	}
+	return ""
+}
+
+// setEMachID stores a newly generated eMachID together with the metadata the
+// rotation triggers are evaluated against.
+func setEMachID(cache *CachedMachineIDs, emachid string, t time.Time) {
+	cache.EMachID = emachid
+	cache.EMachIDCreatedAt = t.Unix()
+	cache.BootID = readBootID()
+	cache.EMachIDBinding = reMachIDFingerprint(cache.ReMachID)
+	cache.EMachIDGeneration++
+}
+
+// rotateEMachID replaces the cached eMachID, retiring the previous one to the
+// history, and resets the action count.
+func rotateEMachID(cache *CachedMachineIDs, emachid, reason string, t time.Time) RotationEvent {
+	event := RotationEvent{OldID: cache.EMachID, NewID: emachid, Reason: reason, Namespace: currentNamespace(), Time: t}
+	retireEMachID(cache, reason, t)
+	setEMachID(cache, emachid, t)
+	cache.ActionCount = 0
+	return event
+}
@@ -0,0 +1,127 @@
+package machid
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func useRotationPolicy(t *testing.T, policy RotationPolicy) *[]RotationEvent {
+	t.Helper()
+	var events []RotationEvent
+	SetRotationPolicy(policy)
+	SetRotationHandler(func(e RotationEvent) { events = append(events, e) })
+	t.Cleanup(func() {
+		SetRotationPolicy(RotationPolicy{})
+		SetRotationHandler(nil)
+	})
+	return &events
+}
+
+func useTempBootID(t *testing.T, id string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "boot_id")
+	os.WriteFile(path, []byte(id+"\n"), 0600)
+	old := bootIDPath
+	bootIDPath = path
+	t.Cleanup(func() { bootIDPath = old })
+	return path
+}
+
+func TestRotationPolicy_MaxActions(t *testing.T) {
+	useMemoryCacheStore(t)
+	events := useRotationPolicy(t, RotationPolicy{MaxActions: 2})
+
+	first, _, err := GetOrGenerateEMachID("test-salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	IncrementActionCount()
+	if id, fromCache, _ := GetOrGenerateEMachID("test-salt"); id != first || !fromCache {
+		t.Fatal("eMachID rotated before the action limit")
+	}
+	IncrementActionCount()
+
+	second, fromCache, err := GetOrGenerateEMachID("test-salt")
+	if err != nil || fromCache || second == first {
+		t.Fatalf("GetOrGenerateEMachID() = %q, %v, %v; expected rotation", second, fromCache, err)
+	}
+	if len(*events) != 1 || (*events)[0].OldID != first || (*events)[0].NewID != second || (*events)[0].Reason != RotationReasonMaxActions {
+		t.Errorf("unexpected rotation events: %+v", *events)
+	}
+	if cache, _ := LoadCachedIDs(); cache.ActionCount != 0 {
+		t.Errorf("action count not reset on rotation: %d", cache.ActionCount)
+	}
+}
+
+func TestRotationPolicy_MaxAge(t *testing.T) {
+	useMemoryCacheStore(t)
+	clock := useFakeClock(t, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC))
+	events := useRotationPolicy(t, RotationPolicy{MaxAge: time.Hour})
+
+	first, _, _ := GetOrGenerateEMachID("test-salt")
+	clock.t = clock.t.Add(59 * time.Minute)
+	if id, _, _ := GetOrGenerateEMachID("test-salt"); id != first {
+		t.Fatal("eMachID rotated before its maximum age")
+	}
+	clock.t = clock.t.Add(time.Minute)
+	if id, _, _ := GetOrGenerateEMachID("test-salt"); id == first {
+		t.Fatal("eMachID not rotated after its maximum age")
+	}
+	if len(*events) != 1 || (*events)[0].Reason != RotationReasonMaxAge || !(*events)[0].Time.Equal(clock.t) {
+		t.Errorf("unexpected rotation events: %+v", *events)
+	}
+}
+
+func TestRotationPolicy_Reboot(t *testing.T) {
+	useMemoryCacheStore(t)
+	bootID := useTempBootID(t, "boot-1")
+	events := useRotationPolicy(t, RotationPolicy{OnReboot: true})
+
+	first, _, _ := GetOrGenerateEMachID("test-salt")
+	if id, _, _ := GetOrGenerateEMachID("test-salt"); id != first {
+		t.Fatal("eMachID rotated without a reboot")
+	}
+	os.WriteFile(bootID, []byte("boot-2\n"), 0600)
+	if id, _, _ := GetOrGenerateEMachID("test-salt"); id == first {
+		t.Fatal("eMachID not rotated after a reboot")
+	}
+	if len(*events) != 1 || (*events)[0].Reason != RotationReasonReboot {
+		t.Errorf("unexpected rotation events: %+v", *events)
+	}
+}
+
+func TestRotationPolicy_ReMachIDChange(t *testing.T) {
+	useMemoryCacheStore(t)
+	events := useRotationPolicy(t, RotationPolicy{OnReMachIDChange: true})
+
+	if err := SaveCachedIDs(&CachedMachineIDs{ReMachID: "remach-1", Salt: "test-salt"}); err != nil {
+		t.Fatal(err)
+	}
+	first, _, _ := GetOrGenerateEMachID("test-salt")
+	UpdateCachedIDs(func(cache *CachedMachineIDs) error {
+		cache.ReMachID = "remach-2"
+		return nil
+	})
+	if id, _, _ := GetOrGenerateEMachID("test-salt"); id == first {
+		t.Fatal("eMachID not rotated after the reMachID changed")
+	}
+	if len(*events) != 1 || (*events)[0].Reason != RotationReasonReMachIDChanged {
+		t.Errorf("unexpected rotation events: %+v", *events)
+	}
+}
+
+func TestRotateEMachID_NotifiesHandler(t *testing.T) {
+	useMemoryCacheStore(t)
+	events := useRotationPolicy(t, RotationPolicy{})
+
+	first, _, _ := GetOrGenerateEMachID("test-salt")
+	second, err := RotateEMachID("test-salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 1 || (*events)[0].OldID != first || (*events)[0].NewID != second || (*events)[0].Reason != RotationReasonManual {
+		t.Errorf("unexpected rotation events: %+v", *events)
+	}
+}
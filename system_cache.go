@@ -0,0 +1,314 @@
+package machid
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ================================================================================
+// System-Wide Cache
+// ================================================================================
+//
+// On shared hosts every user would otherwise need to run the application with
+// sudo once to populate their own cache. The optional system cache is written
+// by root and readable by a configured group, and holds only reMachIDs (never
+// eMachIDs or action counts, which stay per-user).
+//
+// Precedence and staleness:
+//   - A valid system entry (root-owned file, matching salt and MAC, not
+//     expired under the CachePolicy) takes precedence over the per-user cache.
+//     A per-user reMachID that differs from it is stale and is replaced.
+//   - Expired, tampered or insecurely stored system entries are ignored, and
+//     the per-user cache is consulted as usual.
+//   - Whenever root derives a reMachID, both caches are updated.
+
+// DefaultSystemCacheDir is the system cache directory used if none is configured
+const DefaultSystemCacheDir = "/var/lib/machid"
+
+// SystemCacheConfig configures the system-wide reMachID cache.
+type SystemCacheConfig struct {
+	// Dir is the cache directory (DefaultSystemCacheDir if empty)
+	Dir string
+
+	// Group is the name or GID of the group granted read access. If empty,
+	// only root can read the system cache.
+	Group string
+}
+
+var (
+	// systemCache configured with SetSystemCache (nil means disabled)
+	systemCache   *SystemCacheConfig
+	systemCacheMu sync.RWMutex
+)
+
+// SetSystemCache enables the system-wide reMachID cache, which the
+// GetOrGenerate* functions consult before the per-user cache. When running as
+// root, derived reMachIDs are written to it (directory 0750, file 0640, group
+// set to config.Group). Pass nil to disable it.
+//
+// Parameters:
+//   - config: The system cache configuration, or nil to disable
+func SetSystemCache(config *SystemCacheConfig) {
+	systemCacheMu.Lock()
+	defer systemCacheMu.Unlock()
+	if config == nil {
+		systemCache = nil
+		return
+	}
+	copied := *config
+	systemCache = &copied
+}
+
+// GetSystemCache returns the system cache configuration, or nil if disabled.
+func GetSystemCache() *SystemCacheConfig {
+	systemCacheMu.RLock()
+	defer systemCacheMu.RUnlock()
+	if systemCache == nil {
+		return nil
+	}
+	copied := *systemCache
+	return &copied
+}
+
+// activeSystemCacheStore returns the system cache store, or nil if disabled.
+func activeSystemCacheStore() *systemCacheStore {
+	config := GetSystemCache()
+	if config == nil {
+		return nil
+	}
+	dir := config.Dir
+	if dir == "" {
+		dir = DefaultSystemCacheDir
+	}
+	return &systemCacheStore{dir: dir, group: config.Group}
+}
+
+// systemCacheStore stores the system cache. Only root writes it; every file
+// and directory read must be owned by root and not writable by others.
+type systemCacheStore struct {
+	dir   string
+	group string
+}
+
+// path returns the system cache file path.
+func (s *systemCacheStore) path() string {
+	return filepath.Join(s.dir, cacheFile)
+}
+
+// gid returns the GID of the configured group (0 if none).
+func (s *systemCacheStore) gid() (int, error) {
+	if s.group == "" {
+		return 0, nil
+	}
+	g, err := user.LookupGroup(s.group)
+	if err != nil {
+		if g, err = user.LookupGroupId(s.group); err != nil {
+			return 0, fmt.Errorf("machid: system cache group %q: %w", s.group, err)
+		}
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// checkSystemCachePath validates an existing system cache path entry.
+func checkSystemCachePath(path string) (os.FileInfo, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil, fmt.Errorf("%w: %s is a symlink", ErrInsecureCachePath, path)
+	}
+	if owner, ok := fileOwner(fi); ok && owner != 0 {
+		return nil, fmt.Errorf("%w: %s is owned by uid %d", ErrInsecureCachePath, path, owner)
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return nil, fmt.Errorf("%w: %s is writable by non-root users", ErrInsecureCachePath, path)
+	}
+	return fi, nil
+}
+
+// prepareDir creates the system cache directory (root only).
+func (s *systemCacheStore) prepareDir() error {
+	gid, err := s.gid()
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(s.dir, 0750); err != nil && !os.IsExist(err) {
+		return err
+	}
+	fi, err := os.Lstat(s.dir)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 || !fi.IsDir() {
+		return fmt.Errorf("%w: %s is not a directory", ErrInsecureCachePath, s.dir)
+	}
+	if err := os.Lchown(s.dir, 0, gid); err != nil {
+		return err
+	}
+	return os.Chmod(s.dir, 0750)
+}
+
+// Load reads the system cache file.
+func (s *systemCacheStore) Load() ([]byte, error) {
+	if _, err := checkSystemCachePath(s.dir); err != nil {
+		return nil, err
+	}
+	fi, err := checkSystemCachePath(s.path())
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: %s is not a regular file", ErrInsecureCachePath, s.path())
+	}
+
+	f, err := os.OpenFile(s.path(), os.O_RDONLY|oNoFollow, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// Save writes the system cache file (root only).
+func (s *systemCacheStore) Save(data []byte) error {
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	if err := checkRoot(); err != nil {
+		return err
+	}
+	gid, err := s.gid()
+	if err != nil {
+		return err
+	}
+	if err := s.prepareDir(); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path(), data, 0640); err != nil {
+		return err
+	}
+	return os.Lchown(s.path(), 0, gid)
+}
+
+// LockCache takes an exclusive advisory lock on the system cache (root only).
+func (s *systemCacheStore) LockCache() (func(), error) {
+	if err := checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkRoot(); err != nil {
+		return nil, err
+	}
+	if err := s.prepareDir(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.path()+".lock", os.O_RDONLY|os.O_CREATE|oNoFollow, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// Clear removes the system cache file (root only).
+func (s *systemCacheStore) Clear() error {
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	if err := checkRoot(); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadSystemEntry returns the system cache entry for salt if the system cache
+// is enabled and holds a verified entry for it, otherwise nil. Expiry is left
+// to the caller.
+func loadSystemEntry(salt string) *CachedMachineIDs {
+	store := activeSystemCacheStore()
+	if store == nil {
+		return nil
+	}
+
+	data, err := store.Load()
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logWarning(fmt.Sprintf("WARNING: machid - Ignoring system cache: %v", err))
+		}
+		return nil
+	}
+	if data, _, err = openCacheData(nil, data); err != nil {
+		logWarning(fmt.Sprintf("WARNING: machid - Ignoring system cache: %v", err))
+		return nil
+	}
+	doc, _, err := decodeCacheDocument(data)
+	if err != nil {
+		logWarning(fmt.Sprintf("WARNING: machid - Ignoring system cache: %v", err))
+		return nil
+	}
+
+	name, ok := findNamespace(doc, salt, false)
+	if !ok {
+		return nil
+	}
+	entry := doc.Namespaces[name]
+	if entry.ReMachID == "" || !entry.MatchesSalt(salt) {
+		return nil
+	}
+	if err := entry.VerifyReMachID(salt); err != nil {
+		logWarning(fmt.Sprintf("WARNING: machid - Ignoring system cache entry %q: %v", name, err))
+		return nil
+	}
+	return entry
+}
+
+// saveSystemEntry records a reMachID derived at now in the system cache, if
+// it is enabled and the process runs as root.
+func saveSystemEntry(salt, remachid string, policy CachePolicy, now time.Time) {
+	store := activeSystemCacheStore()
+	if store == nil || checkRoot() != nil || IsNoWriteMode() {
+		return
+	}
+
+	err := updateCacheDocumentIn(store, nil, func(doc *cacheDocument) error {
+		name, _ := findNamespace(doc, salt, true)
+		return updateNamespace(doc, name, func(entry *CachedMachineIDs) error {
+			if entry.ReMachID != remachid || entry.CreatedAt == 0 {
+				entry.CreatedAt = now.Unix()
+			}
+			entry.ReMachID = remachid
+			entry.assignSalt(salt)
+			policy.stamp(entry, now)
+			return nil
+		})
+	})
+	if err != nil {
+		logWarning(fmt.Sprintf("WARNING: machid - Failed to update system cache: %v", err))
+	}
+}
+
+// ClearSystemCache removes the system-wide cache. Requires root.
+func ClearSystemCache() error {
+	store := activeSystemCacheStore()
+	if store == nil {
+		return nil
+	}
+	return store.Clear()
+}
@@ -0,0 +1,83 @@
+package machid
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func useTempSystemCache(t *testing.T) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "machid")
+	SetSystemCache(&SystemCacheConfig{Dir: dir, Group: "0"})
+	t.Cleanup(func() { SetSystemCache(nil) })
+	return dir
+}
+
+func TestSetSystemCache(t *testing.T) {
+	if GetSystemCache() != nil {
+		t.Fatal("system cache should be disabled by default")
+	}
+
+	config := &SystemCacheConfig{Group: "builders"}
+	SetSystemCache(config)
+	defer SetSystemCache(nil)
+
+	config.Group = "changed"
+	if got := GetSystemCache(); got == nil || got.Group != "builders" {
+		t.Errorf("GetSystemCache() = %+v; expected a copy of the configuration", got)
+	}
+	if store := activeSystemCacheStore(); store.dir != DefaultSystemCacheDir {
+		t.Errorf("system cache dir = %q, expected %q", store.dir, DefaultSystemCacheDir)
+	}
+}
+
+func TestSystemCache_AsRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+	useMemoryCacheStore(t)
+	useTempFallbackDir(t)
+	useTempLedger(t)
+	dir := useTempSystemCache(t)
+
+	remachid, status, err := GetOrGenerateReMachIDWithStatus("salt")
+	if err != nil || status != CacheStatusRefreshed {
+		t.Fatalf("GetOrGenerateReMachIDWithStatus() = %q, %v, %v", remachid, status, err)
+	}
+
+	dirInfo, err := os.Stat(dir)
+	if err != nil || dirInfo.Mode().Perm() != 0750 {
+		t.Errorf("system cache dir mode = %v, %v; expected 0750", dirInfo, err)
+	}
+	fileInfo, err := os.Stat(filepath.Join(dir, cacheFile))
+	if err != nil || fileInfo.Mode().Perm() != 0640 {
+		t.Errorf("system cache file mode = %v, %v; expected 0640", fileInfo, err)
+	}
+
+	// A stale per-user reMachID loses against the system cache and is replaced
+	useMemoryCacheStore(t)
+	if err := SaveCachedIDs(&CachedMachineIDs{ReMachID: "stale", Salt: "salt"}); err != nil {
+		t.Fatal(err)
+	}
+	again, status, err := GetOrGenerateReMachIDWithStatus("salt")
+	if err != nil || status != CacheStatusTrusted || again != remachid {
+		t.Errorf("GetOrGenerateReMachIDWithStatus() = %q, %v, %v; expected system cache hit %q", again, status, err, remachid)
+	}
+	if cache, err := LoadCachedIDs(); err != nil || cache.ReMachID != remachid || cache.VerifyReMachID("salt") != nil {
+		t.Errorf("per-user cache not synced from system cache: %+v, %v", cache, err)
+	}
+
+	// An insecurely stored system cache is ignored
+	os.Chmod(filepath.Join(dir, cacheFile), 0666)
+	if entry := loadSystemEntry("salt"); entry != nil {
+		t.Error("loadSystemEntry() accepted a world-writable system cache")
+	}
+
+	if err := ClearSystemCache(); err != nil {
+		t.Errorf("ClearSystemCache() failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, cacheFile)); !os.IsNotExist(err) {
+		t.Error("ClearSystemCache() did not remove the system cache")
+	}
+}